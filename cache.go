@@ -5,6 +5,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+	"github.com/karlmcguire/experiments-cache/pkg/tinylfu"
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+	"github.com/karlmcguire/experiments-cache/pkg/wheel"
 	"github.com/karlmcguire/experiments-cache/ring"
 	"github.com/karlmcguire/experiments-cache/snap"
 )
@@ -14,6 +19,12 @@ type (
 		sync.Mutex
 		data     snap.Map
 		buffer   *ring.Buffer
+		admit    *tinylfu.TinyLFU
+		cost     func(interface{}) uint64
+		expiry   *wheel.Wheel
+		start    sync.Once
+		stats    *stats.Recorder
+		notify   removal.Notifier
 		size     uint64
 		capacity uint64
 		sample   uint64
@@ -29,37 +40,88 @@ type (
 	metadata struct {
 		count   uint64
 		created uint64
+		cost    uint64
+		// expiration is in unix nanoseconds, 0 if the value never expires
+		expiration int64
 	}
 )
 
+// NewCache returns a cache holding at most capacity entries.
 func NewCache(capacity uint64) *Cache {
+	return NewCacheCost(capacity, capacity, func(interface{}) uint64 { return 1 })
+}
+
+// NewCacheCost returns a cache bounded by the total cost of its entries rather
+// than the number of entries. The cost function is called on each value passed
+// to Set, SetWithCost can be used if the cost is already known. The expected
+// number of entries is used for sizing the admission policy.
+func NewCacheCost(capacity, entries uint64, cost func(interface{}) uint64) *Cache {
 	// calculate eviction sample size
 	sample := uint64(4)
-	if sample < capacity {
+	if sample > capacity {
 		sample = capacity
 	}
 
-	return &Cache{
-		data:     snap.NewSyncMap(),
+	cache := &Cache{
+		data:     snap.NewHashMap(),
+		admit:    tinylfu.New(entries),
+		cost:     cost,
+		expiry:   wheel.NewWheel(wheel.GRANULARITY),
+		stats:    stats.NewRecorder(),
 		capacity: capacity,
 		sample:   sample,
 	}
+	// accesses are recorded in the buffer and applied to the admission policy
+	// in batches
+	cache.buffer = ring.NewBuffer(ring.LOSSY, &ring.Config{
+		Consumer: cache,
+		Capacity: 64,
+	})
+	return cache
+}
+
+// Push is called by the access buffer when a stripe is drained.
+func (c *Cache) Push(keys []ring.Element) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		c.admit.Increment(util.Hash64([]byte(key)))
+	}
 }
 
 func (c *Cache) Get(key string) interface{} {
-	value := c.data.Get(key).(*Value)
-	value.meta.count++
+	value, ok := c.data.Get(key).(*Value)
+	if !ok {
+		c.stats.Get(false)
+		return nil
+	}
+	// expired values are treated as misses until the timer wheel removes them
+	if wheel.IsExpired(value.meta.expiration) {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
+	atomic.AddUint64(&value.meta.count, 1)
+
+	// record access for the admission policy
+	c.buffer.Push(ring.Element(key))
 	return value
 }
 
-func (c *Cache) Evict() {
+// victim returns the key with the smallest score out of the sampled elements,
+// other than exclude (the key being set), or "" if there are no other keys.
+func (c *Cache) victim(exclude string) string {
 	var (
-		minKey   interface{}
+		minKey   string
 		minScore float64
 		i        uint64
 	)
 
-	c.data.Range(func(key, value interface{}) bool {
+	c.data.Sample(func(key, value interface{}) bool {
+		if key.(string) == exclude {
+			return true
+		}
 		var (
 			meta    = &value.(*Value).meta
 			count   = float64(atomic.LoadUint64(&meta.count))
@@ -67,9 +129,15 @@ func (c *Cache) Evict() {
 			score   = count / created
 		)
 
+		// expired elements are always the victim
+		if wheel.IsExpired(meta.expiration) {
+			minKey = key.(string)
+			return false
+		}
+
 		// keep track of the smallest element score (potential victim)
 		if i == 0 || score < minScore {
-			minKey = key
+			minKey = key.(string)
 			minScore = score
 		}
 
@@ -78,25 +146,165 @@ func (c *Cache) Evict() {
 		return i < c.sample
 	})
 
-	// delete victim
-	c.data.Del(minKey.(string))
+	return minKey
+}
+
+func (c *Cache) Evict() {
+	c.Lock()
+	c.removed(c.evict(c.victim("")), removal.SIZE)
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// evict removes the key and returns its value, or nil if it wasn't present.
+func (c *Cache) evict(victim string) *Value {
+	value, ok := c.data.Get(victim).(*Value)
+	if !ok {
+		return nil
+	}
+	c.data.Del(victim)
+	c.expiry.Del(victim, value.meta.expiration)
+	atomic.AddUint64(&c.size, ^(value.meta.cost - 1))
+	return value
+}
+
+// removed records the removal of a value returned by evict in the stats and
+// notifies the listener. Expired values evicted to make room count as expired.
+func (c *Cache) removed(value *Value, reason removal.Reason) {
+	if value == nil {
+		return
+	}
+	if reason == removal.SIZE && wheel.IsExpired(value.meta.expiration) {
+		reason = removal.EXPIRED
+	}
+	switch reason {
+	case removal.SIZE:
+		c.stats.Evict(stats.SIZE, value.meta.cost)
+	case removal.EXPIRED:
+		c.stats.Evict(stats.EXPIRED, value.meta.cost)
+	}
+	c.notify.Add(value.key, value.data, reason)
+}
+
+// OnEvict sets the listener called with every removed value. It's called after
+// the cache's lock is released.
+func (c *Cache) OnEvict(listener removal.Listener) {
+	c.Lock()
+	defer c.Unlock()
+	c.notify.Listen(listener)
 }
 
-func (c *Cache) Set(key string, data interface{}) {
-	if c.data.Get(key) == nil {
-		if atomic.AddUint64(&c.size, 1) == c.capacity {
-			// we're at full capacity so evict an element
-			c.Evict()
+// expire is called by the timer wheel with keys that may have expired.
+func (c *Cache) expire(keys []string) {
+	c.Lock()
+	for _, key := range keys {
+		// the key may have been set again with a later expiration
+		if value, ok := c.data.Get(key).(*Value); ok &&
+			wheel.IsExpired(value.meta.expiration) {
+			c.removed(c.evict(key), removal.EXPIRED)
 		}
 	}
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// Close stops the background expiration goroutine.
+func (c *Cache) Close() {
+	c.expiry.Stop()
+}
+
+// Cost returns the total cost of all entries in the cache.
+func (c *Cache) Cost() uint64 {
+	return atomic.LoadUint64(&c.size)
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Cache) Stats() stats.Stats {
+	return c.stats.Snapshot(c.buffer)
+}
+
+// Set adds the key-value pair to the cache and returns true if it was admitted.
+// When the cache is full, the new key is only admitted if the TinyLFU policy
+// estimates it to be accessed more often than the sampled victims.
+func (c *Cache) Set(key string, data interface{}) bool {
+	return c.SetWithCost(key, data, c.cost(data))
+}
+
+// SetWithCost is like Set but uses the provided cost instead of calling the
+// cost function. Entries costing more than the capacity are always rejected.
+func (c *Cache) SetWithCost(key string, data interface{}, cost uint64) bool {
+	return c.set(key, data, cost, 0)
+}
+
+// SetWithTTL is like Set but the value expires after ttl. Expired values are
+// misses on Get and are removed in the background.
+func (c *Cache) SetWithTTL(key string, data interface{}, ttl time.Duration) bool {
+	return c.set(key, data, c.cost(data), ttl)
+}
+
+func (c *Cache) set(key string, data interface{}, cost uint64, ttl time.Duration) bool {
+	c.Lock()
+	added := c.add(key, data, cost, ttl)
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+	return added
+}
+
+func (c *Cache) add(key string, data interface{}, cost uint64, ttl time.Duration) bool {
+	if cost > c.capacity {
+		c.stats.Set(cost, false)
+		c.notify.Add(key, data, removal.REJECTED)
+		return false
+	}
+
+	hash := util.Hash64([]byte(key))
+	c.admit.Increment(hash)
+
+	// the old value's cost is freed by replacing it, but it's only removed
+	// once the new value is admitted
+	replaced := uint64(0)
+	if old, ok := c.data.Get(key).(*Value); ok {
+		replaced = old.meta.cost
+	}
+
+	for atomic.LoadUint64(&c.size)-replaced+cost > c.capacity {
+		// we're at full capacity so find a victim and compare
+		victim := c.victim(key)
+		if victim == "" || !c.admit.Admit(hash, util.Hash64([]byte(victim))) {
+			// candidate is colder than the victim, reject it
+			c.stats.Set(cost, false)
+			c.notify.Add(key, data, removal.REJECTED)
+			return false
+		}
+		c.removed(c.evict(victim), removal.SIZE)
+	}
+	c.removed(c.evict(key), removal.REPLACED)
+	atomic.AddUint64(&c.size, cost)
+	c.stats.Set(cost, true)
 
 	// add to the cache
-	c.data.Set(key, &Value{
+	value := &Value{
 		key:  key,
 		data: data,
 		meta: metadata{
-			count:   1,
-			created: uint64(time.Now().UnixNano()),
+			count:      1,
+			created:    uint64(time.Now().UnixNano()),
+			cost:       cost,
+			expiration: wheel.Expiration(ttl),
 		},
-	})
+	}
+	c.data.Set(key, value)
+
+	if value.meta.expiration != 0 {
+		// only start expiring in the background once it's needed
+		c.start.Do(func() { c.expiry.Start(c.expire) })
+		c.expiry.Add(key, value.meta.expiration)
+	}
+	return true
 }
@@ -2,12 +2,21 @@ package cache
 
 import (
 	"container/list"
+	"math"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/allegro/bigcache"
+	"github.com/karlmcguire/experiments-cache/pkg/codec"
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+	"github.com/karlmcguire/experiments-cache/pkg/tinylfu"
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+	"github.com/karlmcguire/experiments-cache/pkg/wheel"
 	"github.com/karlmcguire/experiments-cache/ring"
 )
 
@@ -16,114 +25,318 @@ type (
 		Get(string) *Value
 		Set(string, interface{})
 		Del(string)
+		// Stats returns a snapshot of the cache's counters.
+		Stats() Stats
 	}
 
+	// Stats is a snapshot of cache counters (see the stats package).
+	Stats = stats.Stats
+
 	Value struct {
 		Key  string
 		Data interface{}
 	}
+
+	// CostCache is implemented by caches bounded by the total cost of their
+	// entries rather than the number of entries.
+	CostCache interface {
+		Cache
+		SetWithCost(string, interface{}, uint64) bool
+		Cost() uint64
+	}
+
+	// CostFunc returns the cost of storing data in a CostCache.
+	CostFunc func(data interface{}) uint64
+
+	// TTLCache is implemented by caches supporting per-element expiration.
+	// Expired elements are misses on Get and are removed in the background
+	// until Close is called.
+	TTLCache interface {
+		Cache
+		SetWithTTL(string, interface{}, time.Duration) bool
+		Close()
+	}
+
+	// BytesCache is implemented by caches storing []byte values, so []byte
+	// keys and values don't have to be converted to strings and interfaces.
+	BytesCache interface {
+		// GetBytes appends the value to dst and returns it, along with false
+		// on a miss.
+		GetBytes(dst, key []byte) ([]byte, bool)
+		SetBytes(key, value []byte)
+		DelBytes(key []byte)
+	}
+
+	// RemovalReason is why a value left the cache (see the removal package).
+	RemovalReason = removal.Reason
+
+	// RemovalListener is called with each value leaving the cache. It's called
+	// after the cache's locks are released, by whichever goroutine caused the
+	// removal (the timer wheel's goroutine for expirations).
+	RemovalListener = removal.Listener
+
+	// RemovalCache is implemented by caches that notify a listener of
+	// removals.
+	RemovalCache interface {
+		Cache
+		OnEvict(RemovalListener)
+	}
 )
 
+// unitCost makes a CostCache behave like it's bounded by number of entries.
+func unitCost(interface{}) uint64 { return 1 }
+
+// record counts a removal in the stats if it was an eviction.
+func record(recorder *stats.Recorder, reason RemovalReason, cost uint64) {
+	switch reason {
+	case removal.SIZE:
+		recorder.Evict(stats.SIZE, cost)
+	case removal.EXPIRED:
+		recorder.Evict(stats.EXPIRED, cost)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 type (
+	MapCacheItem struct {
+		Value      *Value
+		Cost       uint64
+		Expiration int64
+	}
+
 	MapCache struct {
-		sync.RWMutex
-		data map[string]*list.Element
-		lru  *list.List
-		size int
+		sync.Mutex
+		data   map[string]*list.Element
+		lru    *list.List
+		cost   CostFunc
+		expiry *wheel.Wheel
+		start  sync.Once
+		stats  *stats.Recorder
+		notify removal.Notifier
+		used   uint64
+		size   uint64
 	}
 )
 
 func NewMapCache(size int) *MapCache {
+	return NewMapCacheCost(uint64(size), unitCost)
+}
+
+// NewMapCacheCost returns a MapCache bounded by the total cost of its entries.
+func NewMapCacheCost(size uint64, cost CostFunc) *MapCache {
 	return &MapCache{
-		data: make(map[string]*list.Element),
-		lru:  list.New(),
-		size: size,
+		data:   make(map[string]*list.Element),
+		lru:    list.New(),
+		cost:   cost,
+		expiry: wheel.NewWheel(wheel.GRANULARITY),
+		stats:  stats.NewRecorder(),
+		size:   size,
 	}
 }
 
 func (c *MapCache) Get(key string) *Value {
-	c.RLock()
-	defer c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
 
 	// check if list element exists in data store
 	element, exists := c.data[key]
 	if !exists {
+		c.stats.Get(false)
 		return nil
 	}
 
+	// expired elements are misses until the timer wheel removes them
+	item := element.Value.(*MapCacheItem)
+	if wheel.IsExpired(item.Expiration) {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
+
 	// maintain access order
 	c.lru.MoveToFront(element)
 
 	// return actual value inside list element
-	return element.Value.(*Value)
+	return item.Value
 }
 
 func (c *MapCache) Set(key string, data interface{}) {
+	c.set(key, data, c.cost(data), 0)
+}
+
+// SetWithCost adds or replaces the element, evicting until it fits. Elements
+// costing more than the whole cache are rejected.
+func (c *MapCache) SetWithCost(key string, data interface{}, cost uint64) bool {
+	return c.set(key, data, cost, 0)
+}
+
+// SetWithTTL is like Set but the element expires after ttl.
+func (c *MapCache) SetWithTTL(key string, data interface{}, ttl time.Duration) bool {
+	return c.set(key, data, c.cost(data), ttl)
+}
+
+func (c *MapCache) set(key string, data interface{}, cost uint64, ttl time.Duration) bool {
 	c.Lock()
-	defer c.Unlock()
+	added := c.add(key, data, cost, ttl)
+	delivery := c.notify.Flush()
+	c.Unlock()
 
-	// element already exists
-	if _, exists := c.data[key]; exists {
-		return
-	}
+	delivery.Deliver()
+	return added
+}
 
-	// check if eviction is needed
-	if len(c.data) == c.size {
-		// eviction is needed, get the victim
-		victim := c.lru.Back()
-		// remove the victim from lru list
-		c.lru.Remove(victim)
-		// remove the victim from data store
-		delete(c.data, victim.Value.(*Value).Key)
+func (c *MapCache) add(key string, data interface{}, cost uint64, ttl time.Duration) bool {
+	// expired elements don't keep the key from being set again
+	if element, exists := c.data[key]; exists &&
+		wheel.IsExpired(element.Value.(*MapCacheItem).Expiration) {
+		c.remove(element, removal.EXPIRED)
 	}
 
-	// add new element
-	c.data[key] = c.lru.PushFront(&Value{key, data})
-}
+	// element can never fit
+	if cost > c.size {
+		c.stats.Set(cost, false)
+		c.notify.Add(key, data, removal.REJECTED)
+		return false
+	}
+	c.stats.Set(cost, true)
+
+	// overwrite existing elements in place, keeping their recency
+	item := &MapCacheItem{&Value{key, data}, cost, wheel.Expiration(ttl)}
+	if element, exists := c.data[key]; exists {
+		old := element.Value.(*MapCacheItem)
+		c.expiry.Del(key, old.Expiration)
+		element.Value = item
+		c.lru.MoveToFront(element)
+		atomic.AddUint64(&c.used, cost-old.Cost)
+		c.notify.Add(key, old.Value.Data, removal.REPLACED)
+	} else {
+		// add new element
+		c.data[key] = c.lru.PushFront(item)
+		atomic.AddUint64(&c.used, cost)
+	}
 
-func (c *MapCache) Del(key string) {
-	c.Lock()
-	defer c.Unlock()
+	if item.Expiration != 0 {
+		c.start.Do(func() { c.expiry.Start(c.expire) })
+		c.expiry.Add(key, item.Expiration)
+	}
 
-	element, exists := c.data[key]
-	if !exists {
-		return
+	// evict until everything fits, the new element is at the front so it's
+	// the last to go
+	for atomic.LoadUint64(&c.used) > c.size {
+		c.remove(c.lru.Back(), removal.SIZE)
 	}
+	return true
+}
 
+func (c *MapCache) remove(element *list.Element, reason RemovalReason) {
+	item := element.Value.(*MapCacheItem)
 	// remove from list
 	c.lru.Remove(element)
 	// remove from data store
-	delete(c.data, key)
+	delete(c.data, item.Value.Key)
+	c.expiry.Del(item.Value.Key, item.Expiration)
+	atomic.AddUint64(&c.used, ^(item.Cost - 1))
+
+	record(c.stats, reason, item.Cost)
+	c.notify.Add(item.Value.Key, item.Value.Data, reason)
+}
+
+// expire is called by the timer wheel with keys that may have expired.
+func (c *MapCache) expire(keys []string) {
+	c.Lock()
+	for _, key := range keys {
+		if element, exists := c.data[key]; exists &&
+			wheel.IsExpired(element.Value.(*MapCacheItem).Expiration) {
+			c.remove(element, removal.EXPIRED)
+		}
+	}
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// Close stops the background expiration goroutine.
+func (c *MapCache) Close() {
+	c.expiry.Stop()
+}
+
+// Cost returns the total cost of all elements in the cache.
+func (c *MapCache) Cost() uint64 {
+	return atomic.LoadUint64(&c.used)
+}
+
+func (c *MapCache) Del(key string) {
+	c.Lock()
+	if element, exists := c.data[key]; exists {
+		c.remove(element, removal.EXPLICIT)
+	}
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// OnEvict sets the listener called with every removed element.
+func (c *MapCache) OnEvict(listener RemovalListener) {
+	c.Lock()
+	defer c.Unlock()
+	c.notify.Listen(listener)
+}
+
+func (c *MapCache) Stats() Stats {
+	return c.stats.Snapshot()
 }
 
 func (c *MapCache) candidate() string {
-	return c.lru.Back().Value.(*Value).Key
+	return c.lru.Back().Value.(*MapCacheItem).Value.Key
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 type (
+	MapWrapCacheItem struct {
+		Value      *Value
+		Cost       uint64
+		Expiration int64
+	}
+
 	MapWrapCache struct {
 		sync.RWMutex
 		data   map[string]*list.Element
 		lru    *list.List
 		lruMu  sync.Mutex
 		access *ring.Buffer
-		size   int
+		cost   CostFunc
+		expiry *wheel.Wheel
+		start  sync.Once
+		stats  *stats.Recorder
+		notify removal.Notifier
+		used   uint64
+		size   uint64
 	}
 )
 
 func NewMapWrapCache(size int) *MapWrapCache {
+	return NewMapWrapCacheCost(uint64(size), size, unitCost)
+}
+
+// NewMapWrapCacheCost returns a MapWrapCache bounded by the total cost of its
+// entries. The expected number of entries is used for sizing the access
+// buffer.
+func NewMapWrapCacheCost(size uint64, entries int, cost CostFunc) *MapWrapCache {
 	cache := &MapWrapCache{
-		data: make(map[string]*list.Element, size),
-		lru:  list.New(),
-		size: size,
+		data:   make(map[string]*list.Element, entries),
+		lru:    list.New(),
+		cost:   cost,
+		expiry: wheel.NewWheel(wheel.GRANULARITY),
+		stats:  stats.NewRecorder(),
+		size:   size,
 	}
 	cache.access = ring.NewBuffer(ring.LOSSY, &ring.Config{
 		Consumer: cache,
-		Capacity: size * 64,
+		Capacity: entries * 64,
 	})
 	return cache
 }
@@ -133,6 +346,7 @@ func (c *MapWrapCache) Push(keys []ring.Element) {
 	defer c.lruMu.Unlock()
 
 	for _, key := range keys {
+		// ring.Element is a string, so converting it doesn't allocate
 		if element, exists := c.data[string(key)]; exists {
 			c.lru.MoveToFront(element)
 		}
@@ -145,11 +359,20 @@ func (c *MapWrapCache) Get(key string) *Value {
 
 	element, exists := c.data[key]
 	if !exists {
+		c.stats.Get(false)
 		return nil
 	}
 
+	// expired elements are misses until the timer wheel removes them
+	item := element.Value.(*MapWrapCacheItem)
+	if wheel.IsExpired(item.Expiration) {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
+
 	// get value from list element
-	value := element.Value.(*Value)
+	value := item.Value
 
 	// record access in buffer
 	c.access.Push(ring.Element(value.Key))
@@ -157,147 +380,1012 @@ func (c *MapWrapCache) Get(key string) *Value {
 	return value
 }
 
+// GetBytes doesn't allocate, the stored key is recorded in the access buffer
+// rather than converting key. Values that aren't []byte are misses.
+func (c *MapWrapCache) GetBytes(dst, key []byte) ([]byte, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	element, exists := c.data[string(key)]
+	if !exists {
+		c.stats.Get(false)
+		return dst, false
+	}
+	item := element.Value.(*MapWrapCacheItem)
+	data, ok := item.Value.Data.([]byte)
+	if !ok || wheel.IsExpired(item.Expiration) {
+		c.stats.Get(false)
+		return dst, false
+	}
+	c.stats.Get(true)
+	c.access.Push(ring.Element(item.Value.Key))
+	return append(dst, data...), true
+}
+
+// SetBytes stores a copy of the value.
+func (c *MapWrapCache) SetBytes(key, value []byte) {
+	data := append([]byte{}, value...)
+	c.set(string(key), data, c.cost(data), 0)
+}
+
+func (c *MapWrapCache) DelBytes(key []byte) {
+	c.Del(string(key))
+}
+
 func (c *MapWrapCache) Set(key string, data interface{}) {
+	c.set(key, data, c.cost(data), 0)
+}
+
+// SetWithCost adds or replaces the element, evicting until it fits. Elements
+// costing more than the whole cache are rejected.
+func (c *MapWrapCache) SetWithCost(key string, data interface{}, cost uint64) bool {
+	return c.set(key, data, cost, 0)
+}
+
+// SetWithTTL is like Set but the element expires after ttl.
+func (c *MapWrapCache) SetWithTTL(key string, data interface{}, ttl time.Duration) bool {
+	return c.set(key, data, c.cost(data), ttl)
+}
+
+func (c *MapWrapCache) set(key string, data interface{}, cost uint64, ttl time.Duration) bool {
+	c.Lock()
+	added := c.add(key, data, cost, ttl)
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+	return added
+}
+
+func (c *MapWrapCache) add(key string, data interface{}, cost uint64, ttl time.Duration) bool {
 	c.lruMu.Lock()
 	defer c.lruMu.Unlock()
 
-	// check if eviction is needed
-	if c.lru.Len() == c.size {
-		// eviction is needed, get the victim
-		victim := c.lru.Back()
-		// remove the victim from lru list
-		c.lru.Remove(victim)
-		// remove the victim from data store
-		delete(c.data, victim.Value.(*Value).Key)
+	// element can never fit
+	if cost > c.size {
+		c.stats.Set(cost, false)
+		c.notify.Add(key, data, removal.REJECTED)
+		return false
+	}
+	c.stats.Set(cost, true)
+
+	// overwrite existing values in place
+	item := &MapWrapCacheItem{&Value{key, data}, cost, wheel.Expiration(ttl)}
+	if element, exists := c.data[key]; exists {
+		old := element.Value.(*MapWrapCacheItem)
+		c.expiry.Del(key, old.Expiration)
+		element.Value = item
+		c.lru.MoveToFront(element)
+		atomic.AddUint64(&c.used, cost-old.Cost)
+		c.notify.Add(key, old.Value.Data, removal.REPLACED)
+	} else {
+		// add new element to store
+		c.data[key] = c.lru.PushFront(item)
+		atomic.AddUint64(&c.used, cost)
 	}
 
-	// add new element to store
-	c.data[key] = c.lru.PushFront(&Value{key, data})
+	if item.Expiration != 0 {
+		c.start.Do(func() { c.expiry.Start(c.expire) })
+		c.expiry.Add(key, item.Expiration)
+	}
+
+	// evict until everything fits, the new element is at the front so it's
+	// the last to go
+	for atomic.LoadUint64(&c.used) > c.size {
+		c.remove(c.lru.Back(), removal.SIZE)
+	}
+	return true
+}
+
+// remove should be called while holding both locks.
+func (c *MapWrapCache) remove(element *list.Element, reason RemovalReason) {
+	item := element.Value.(*MapWrapCacheItem)
+	c.lru.Remove(element)
+	delete(c.data, item.Value.Key)
+	c.expiry.Del(item.Value.Key, item.Expiration)
+	atomic.AddUint64(&c.used, ^(item.Cost - 1))
+
+	record(c.stats, reason, item.Cost)
+	c.notify.Add(item.Value.Key, item.Value.Data, reason)
+}
+
+// expire is called by the timer wheel with keys that may have expired.
+func (c *MapWrapCache) expire(keys []string) {
+	c.Lock()
+	c.lruMu.Lock()
+	for _, key := range keys {
+		if element, exists := c.data[key]; exists &&
+			wheel.IsExpired(element.Value.(*MapWrapCacheItem).Expiration) {
+			c.remove(element, removal.EXPIRED)
+		}
+	}
+	c.lruMu.Unlock()
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// Close stops the background expiration goroutine.
+func (c *MapWrapCache) Close() {
+	c.expiry.Stop()
 }
 
 func (c *MapWrapCache) Del(key string) {
+	c.Lock()
+	if element, exists := c.data[key]; exists {
+		c.lruMu.Lock()
+		c.remove(element, removal.EXPLICIT)
+		c.lruMu.Unlock()
+	}
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// Cost returns the total cost of all elements in the cache.
+func (c *MapWrapCache) Cost() uint64 {
+	return atomic.LoadUint64(&c.used)
+}
+
+// OnEvict sets the listener called with every removed element.
+func (c *MapWrapCache) OnEvict(listener RemovalListener) {
 	c.Lock()
 	defer c.Unlock()
+	c.notify.Listen(listener)
+}
+
+func (c *MapWrapCache) Stats() Stats {
+	return c.stats.Snapshot(c.access)
+}
+
+func (c *MapWrapCache) candidate() string {
+	return c.lru.Back().Value.(*MapWrapCacheItem).Value.Key
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	WINDOW = iota
+	PROBATION
+	PROTECTED
+)
+
+const (
+	// WINDOW_START is the initial fraction of capacity given to the window.
+	WINDOW_START = 0.01
+	// PROTECTED_RATIO is the fraction of the main region that is protected.
+	PROTECTED_RATIO = 0.8
+	// CLIMB_SAMPLE is multiplied by the expected number of entries to get the
+	// number of accesses between each hill climbing step.
+	CLIMB_SAMPLE = 10
+	// CLIMB_STEP is the initial fraction of capacity the window is resized by.
+	CLIMB_STEP = 0.0625
+	// CLIMB_DECAY is multiplied by the step size after each climb so that the
+	// window settles once a good size is found.
+	CLIMB_DECAY = 0.98
+	// CLIMB_RESTART is the change in hit rate between samples that restarts
+	// the step size, as the workload has likely changed.
+	CLIMB_RESTART = 0.05
+)
+
+type (
+	WTinyLFUItem struct {
+		Value      *Value
+		Hash       uint64
+		Cost       uint64
+		Expiration int64
+		Region     int
+	}
+
+	// WTinyLFU splits capacity into a small LRU admission window and a
+	// segmented LRU main region (probation and protected). Entries evicted from
+	// the window only make it into the main region if TinyLFU estimates they're
+	// accessed more often than the main region's victim. The window size is
+	// adjusted at runtime by hill climbing on the observed hit rate.
+	//
+	// See: https://github.com/ben-manes/caffeine/wiki/Efficiency
+	WTinyLFU struct {
+		sync.Mutex
+		data      map[string]*list.Element
+		window    *list.List
+		probation *list.List
+		protected *list.List
+		admit     *tinylfu.TinyLFU
+		cost      CostFunc
+		expiry    *wheel.Wheel
+		start     sync.Once
+		stats     *stats.Recorder
+		notify    removal.Notifier
+		used      uint64
+		size      uint64
+
+		// current region sizes and costs
+		windowSize    uint64
+		protectedSize uint64
+		windowUsed    uint64
+		probationUsed uint64
+		protectedUsed uint64
+
+		// hill climbing state
+		hits     int
+		misses   int
+		sample   int
+		prevRate float64
+		step     float64
+	}
+)
+
+func NewWTinyLFU(size int) *WTinyLFU {
+	return NewWTinyLFUCost(uint64(size), size, unitCost)
+}
+
+// NewWTinyLFUCost returns a WTinyLFU bounded by the total cost of its entries.
+// The expected number of entries is used for sizing the frequency sketch and
+// the hill climbing sample. It panics if size is 0, as there's no room for the
+// window.
+func NewWTinyLFUCost(size uint64, entries int, cost CostFunc) *WTinyLFU {
+	if size == 0 {
+		panic("wtinylfu: size must be at least 1")
+	}
+	cache := &WTinyLFU{
+		data:      make(map[string]*list.Element, entries),
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		admit:     tinylfu.New(uint64(entries)),
+		cost:      cost,
+		expiry:    wheel.NewWheel(wheel.GRANULARITY),
+		stats:     stats.NewRecorder(),
+		size:      size,
+		sample:    entries * CLIMB_SAMPLE,
+		step:      CLIMB_STEP * float64(size),
+	}
+	cache.resize(uint64(float64(size) * WINDOW_START))
+	return cache
+}
+
+// resize sets the window size (keeping room in both the window and the main
+// region, unless size is 1) and the protected size based on what's left over.
+func (c *WTinyLFU) resize(windowSize uint64) {
+	if windowSize > c.size-1 {
+		windowSize = c.size - 1
+	}
+	if windowSize < 1 {
+		windowSize = 1
+	}
+	c.windowSize = windowSize
+	c.protectedSize = uint64(float64(c.size-c.windowSize) * PROTECTED_RATIO)
+}
+
+// climb adjusts the window size once enough accesses have been sampled. If the
+// hit rate got worse since the last adjustment, the direction is reversed. If
+// it changed by more than CLIMB_RESTART, the decayed step is reset so the
+// window can adapt to the new workload.
+func (c *WTinyLFU) climb() {
+	if c.hits+c.misses < c.sample {
+		return
+	}
+
+	rate := float64(c.hits) / float64(c.hits+c.misses)
+	change := rate - c.prevRate
+	if change < 0 {
+		c.step = -c.step
+	}
+	if math.Abs(change) >= CLIMB_RESTART {
+		c.step = math.Copysign(CLIMB_STEP*float64(c.size), c.step)
+	}
+	c.prevRate = rate
+	c.hits, c.misses = 0, 0
+
+	// clamp the step so the window stays between 1 and size-1
+	step, window := int64(c.step), int64(c.windowSize)
+	if max := int64(c.size) - 1 - window; step > max {
+		step = max
+	}
+	if min := 1 - window; step < min {
+		step = min
+	}
+	c.resize(uint64(window + step))
+	c.step *= CLIMB_DECAY
+}
+
+func (c *WTinyLFU) Get(key string) *Value {
+	c.Lock()
+	value := c.get(key)
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+	return value
+}
+
+func (c *WTinyLFU) get(key string) *Value {
+	defer c.climb()
 
 	element, exists := c.data[key]
 	if !exists {
-		return
+		c.misses++
+		c.stats.Get(false)
+		return nil
 	}
-	delete(c.data, key)
 
-	c.lruMu.Lock()
-	defer c.lruMu.Unlock()
-	// remove from list
-	c.lru.Remove(element)
+	item := element.Value.(*WTinyLFUItem)
+	if wheel.IsExpired(item.Expiration) {
+		c.misses++
+		c.stats.Get(false)
+		c.remove(element, removal.EXPIRED)
+		return nil
+	}
+	c.hits++
+	c.stats.Get(true)
+
+	c.admit.Increment(item.Hash)
+	c.access(element)
+	return item.Value
 }
 
-func (c *MapWrapCache) candidate() string {
-	return c.lru.Back().Value.(*Value).Key
+// access maintains access order within the segments, promoting probation
+// entries to protected.
+func (c *WTinyLFU) access(element *list.Element) {
+	switch element.Value.(*WTinyLFUItem).Region {
+	case WINDOW:
+		c.window.MoveToFront(element)
+	case PROTECTED:
+		c.protected.MoveToFront(element)
+	case PROBATION:
+		c.push(c.unlink(element), PROTECTED)
+
+		// demote protected entries if it's full
+		for c.protectedUsed > c.protectedSize && c.protected.Len() > 1 {
+			c.push(c.unlink(c.protected.Back()), PROBATION)
+		}
+	}
+}
+
+func (c *WTinyLFU) Set(key string, data interface{}) {
+	c.set(key, data, c.cost(data), 0)
+}
+
+// SetWithCost adds the element to the window and returns true if it's still in
+// the cache after evicting. Elements costing more than the whole cache are
+// rejected.
+func (c *WTinyLFU) SetWithCost(key string, data interface{}, cost uint64) bool {
+	return c.set(key, data, cost, 0)
+}
+
+// SetWithTTL is like Set but the element expires after ttl.
+func (c *WTinyLFU) SetWithTTL(key string, data interface{}, ttl time.Duration) bool {
+	return c.set(key, data, c.cost(data), ttl)
+}
+
+func (c *WTinyLFU) set(key string, data interface{}, cost uint64, ttl time.Duration) bool {
+	c.Lock()
+	added := c.add(key, data, cost, ttl)
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+	return added
+}
+
+func (c *WTinyLFU) add(key string, data interface{}, cost uint64, ttl time.Duration) bool {
+	if cost > c.size {
+		c.stats.Set(cost, false)
+		c.notify.Add(key, data, removal.REJECTED)
+		return false
+	}
+
+	expiration := wheel.Expiration(ttl)
+
+	// element already exists, update the value and count it as an access
+	if element, exists := c.data[key]; exists {
+		item := c.unlink(element)
+		c.notify.Add(key, item.Value.Data, removal.REPLACED)
+		atomic.AddUint64(&c.used, cost-item.Cost)
+		c.expiry.Del(key, item.Expiration)
+		item.Value = &Value{key, data}
+		item.Cost = cost
+		item.Expiration = expiration
+		c.push(item, item.Region)
+		c.admit.Increment(item.Hash)
+		c.access(c.data[key])
+	} else {
+		hash := util.Hash64([]byte(key))
+		c.admit.Increment(hash)
+
+		// new elements always start in the window
+		c.push(&WTinyLFUItem{
+			Value:      &Value{key, data},
+			Hash:       hash,
+			Cost:       cost,
+			Expiration: expiration,
+		}, WINDOW)
+		atomic.AddUint64(&c.used, cost)
+	}
+
+	if expiration != 0 {
+		c.start.Do(func() { c.expiry.Start(c.expire) })
+		c.expiry.Add(key, expiration)
+	}
+
+	c.evict(key)
+
+	_, exists := c.data[key]
+	c.stats.Set(cost, exists)
+	return exists
+}
+
+// evict moves window overflow into the main region and then evicts from the
+// main region until everything fits (the window may have grown after a climb).
+// If key (the element being set) is dropped it's a rejection, not an eviction.
+func (c *WTinyLFU) evict(key string) {
+	reason := func(item *WTinyLFUItem) RemovalReason {
+		if item.Value.Key == key {
+			return removal.REJECTED
+		}
+		return removal.SIZE
+	}
+
+	for c.windowUsed > c.windowSize && c.window.Len() > 0 {
+		candidate := c.unlink(c.window.Back())
+		if !c.promote(candidate) {
+			r := reason(candidate)
+			record(c.stats, r, candidate.Cost)
+			c.notify.Add(candidate.Value.Key, candidate.Value.Data, r)
+		}
+	}
+
+	for atomic.LoadUint64(&c.used) > c.size {
+		victim := c.victim()
+		c.remove(victim, reason(victim.Value.(*WTinyLFUItem)))
+	}
+}
+
+// promote moves a candidate from the window into the probation segment if
+// there's room or TinyLFU prefers it over the main region's victims. Returns
+// false if the candidate was dropped instead.
+func (c *WTinyLFU) promote(candidate *WTinyLFUItem) bool {
+	for c.probationUsed+c.protectedUsed+candidate.Cost > c.size-c.windowSize {
+		victim := c.mainVictim()
+		if victim == nil {
+			break
+		}
+		if !c.admit.Admit(candidate.Hash, victim.Value.(*WTinyLFUItem).Hash) {
+			// candidate is colder than the victim, drop it
+			delete(c.data, candidate.Value.Key)
+			c.expiry.Del(candidate.Value.Key, candidate.Expiration)
+			atomic.AddUint64(&c.used, ^(candidate.Cost - 1))
+			return false
+		}
+		c.remove(victim, removal.SIZE)
+	}
+
+	c.push(candidate, PROBATION)
+	return true
+}
+
+// mainVictim returns the least recently used element of the main region.
+func (c *WTinyLFU) mainVictim() *list.Element {
+	if victim := c.probation.Back(); victim != nil {
+		return victim
+	}
+	return c.protected.Back()
+}
+
+// victim returns the next element to be evicted, falling back to the window if
+// the main region is empty.
+func (c *WTinyLFU) victim() *list.Element {
+	if victim := c.mainVictim(); victim != nil {
+		return victim
+	}
+	return c.window.Back()
+}
+
+// push adds the item to the front of a segment.
+func (c *WTinyLFU) push(item *WTinyLFUItem, region int) {
+	item.Region = region
+
+	switch region {
+	case WINDOW:
+		c.windowUsed += item.Cost
+		c.data[item.Value.Key] = c.window.PushFront(item)
+	case PROBATION:
+		c.probationUsed += item.Cost
+		c.data[item.Value.Key] = c.probation.PushFront(item)
+	case PROTECTED:
+		c.protectedUsed += item.Cost
+		c.data[item.Value.Key] = c.protected.PushFront(item)
+	}
+}
+
+// unlink removes the element from its segment, leaving it in the data map.
+func (c *WTinyLFU) unlink(element *list.Element) *WTinyLFUItem {
+	item := element.Value.(*WTinyLFUItem)
+
+	switch item.Region {
+	case WINDOW:
+		c.windowUsed -= item.Cost
+		c.window.Remove(element)
+	case PROBATION:
+		c.probationUsed -= item.Cost
+		c.probation.Remove(element)
+	case PROTECTED:
+		c.protectedUsed -= item.Cost
+		c.protected.Remove(element)
+	}
+	return item
+}
+
+func (c *WTinyLFU) remove(element *list.Element, reason RemovalReason) {
+	item := c.unlink(element)
+	delete(c.data, item.Value.Key)
+	c.expiry.Del(item.Value.Key, item.Expiration)
+	atomic.AddUint64(&c.used, ^(item.Cost - 1))
+
+	record(c.stats, reason, item.Cost)
+	c.notify.Add(item.Value.Key, item.Value.Data, reason)
+}
+
+// expire is called by the timer wheel with keys that may have expired.
+func (c *WTinyLFU) expire(keys []string) {
+	c.Lock()
+	for _, key := range keys {
+		if element, exists := c.data[key]; exists &&
+			wheel.IsExpired(element.Value.(*WTinyLFUItem).Expiration) {
+			c.remove(element, removal.EXPIRED)
+		}
+	}
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// Close stops the background expiration goroutine.
+func (c *WTinyLFU) Close() {
+	c.expiry.Stop()
+}
+
+func (c *WTinyLFU) Del(key string) {
+	c.Lock()
+	if element, exists := c.data[key]; exists {
+		c.remove(element, removal.EXPLICIT)
+	}
+	delivery := c.notify.Flush()
+	c.Unlock()
+
+	delivery.Deliver()
+}
+
+// OnEvict sets the listener called with every removed element.
+func (c *WTinyLFU) OnEvict(listener RemovalListener) {
+	c.Lock()
+	defer c.Unlock()
+	c.notify.Listen(listener)
+}
+
+// Cost returns the total cost of all elements in the cache.
+func (c *WTinyLFU) Cost() uint64 {
+	return atomic.LoadUint64(&c.used)
+}
+
+func (c *WTinyLFU) Stats() Stats {
+	return c.stats.Snapshot()
+}
+
+func (c *WTinyLFU) candidate() string {
+	c.Lock()
+	defer c.Unlock()
+
+	if victim := c.victim(); victim != nil {
+		return victim.Value.(*WTinyLFUItem).Value.Key
+	}
+	return ""
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 type (
+	// lockFreeRef is an immutable (next, marked) pair. Nodes point to their
+	// successor through a ref so that both can be swapped with a single CAS,
+	// which is how Go gets around not having tagged pointers.
+	lockFreeRef struct {
+		node   *LockFreeNode
+		marked bool
+	}
+
 	LockFreeNode struct {
-		key  string
-		next *LockFreeNode
-		prev *LockFreeNode
+		key   string
+		entry *LockFreeEntry
+		next  unsafe.Pointer // *lockFreeRef
+		prev  unsafe.Pointer // *LockFreeNode, only a hint for unlinking
 	}
 
+	// LockFreeList is a lock-free LRU list with the least recently used node
+	// at the head and most recently used at the tail. Accesses append a new
+	// node and logically delete the entry's previous one by marking it, marked
+	// nodes are then physically unlinked using their prev hints, by walks from
+	// the head (Evict and Clean), or whichever comes first.
+	//
+	// Marked nodes that aren't the last node in the list never have their next
+	// pointer changed again, so a walk starting from any node (even an unlinked
+	// one) will always make its way back to the end of the list.
+	//
+	// See: https://www.cl.cam.ac.uk/research/srg/netos/papers/2001-caslists.pdf
 	LockFreeList struct {
-		head *LockFreeNode
-		tail *LockFreeNode
+		head   *LockFreeNode
+		tail   unsafe.Pointer // *LockFreeNode, only a hint for appending
+		length int64
+	}
+
+	LockFreeEntry struct {
+		value      *Value
+		expiration int64
+		node       unsafe.Pointer // *LockFreeNode, current position in the list
 	}
 
 	LockFreeCache struct {
 		sync.Mutex
-		data map[string]atomic.Value
-		lru  *LockFreeList
-		size int
+		data   *sync.Map
+		lru    *LockFreeList
+		expiry *wheel.Wheel
+		start  sync.Once
+		stats  *stats.Recorder
+		notify removal.Notifier
+		count  int
+		size   int
 	}
 )
 
-func (l *LockFreeList) Offer(key string) {
+// lockFreeRemoved is stored as an entry's node once it's been deleted or
+// evicted so that racing Offers don't add it back to the list.
+var lockFreeRemoved = &LockFreeNode{}
+
+func (n *LockFreeNode) load() *lockFreeRef {
+	return (*lockFreeRef)(atomic.LoadPointer(&n.next))
 }
 
+func (n *LockFreeNode) cas(old, new *lockFreeRef) bool {
+	return atomic.CompareAndSwapPointer(
+		&n.next, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+// mark logically deletes the node and returns true if this call marked it.
+func (n *LockFreeNode) mark() bool {
+	for {
+		ref := n.load()
+		if ref.marked {
+			return false
+		}
+		if n.cas(ref, &lockFreeRef{ref.node, true}) {
+			return true
+		}
+	}
+}
+
+func NewLockFreeList() *LockFreeList {
+	head := &LockFreeNode{next: unsafe.Pointer(&lockFreeRef{})}
+	return &LockFreeList{
+		head: head,
+		tail: unsafe.Pointer(head),
+	}
+}
+
+// Len returns the number of linked nodes, including marked nodes that haven't
+// been unlinked yet.
+func (l *LockFreeList) Len() int {
+	return int(atomic.LoadInt64(&l.length))
+}
+
+// append adds the node to the end (MRU position) of the list.
+func (l *LockFreeList) append(node *LockFreeNode) {
+	node.next = unsafe.Pointer(&lockFreeRef{})
+
+	for {
+		// walk from the tail hint to the actual last node
+		last := (*LockFreeNode)(atomic.LoadPointer(&l.tail))
+		ref := last.load()
+		for ref.node != nil {
+			last = ref.node
+			ref = last.load()
+		}
+
+		atomic.StorePointer(&node.prev, unsafe.Pointer(last))
+		// the last node is never unlinked, so it's fine to append to it even
+		// if it's marked (the mark is kept)
+		if last.cas(ref, &lockFreeRef{node, ref.marked}) {
+			atomic.StorePointer(&l.tail, unsafe.Pointer(node))
+			atomic.AddInt64(&l.length, 1)
+			// a marked last node couldn't be unlinked until now
+			if ref.marked {
+				l.unlink((*LockFreeNode)(atomic.LoadPointer(&last.prev)), last)
+			}
+			return
+		}
+	}
+}
+
+// unlink physically removes the marked node following pred. This fails if pred
+// is marked, isn't followed by node, or node is the last node in the list.
+func (l *LockFreeList) unlink(pred, node *LockFreeNode) bool {
+	ref := node.load()
+	if !ref.marked || ref.node == nil {
+		return false
+	}
+	predRef := pred.load()
+	if predRef.marked || predRef.node != node {
+		return false
+	}
+	if pred.cas(predRef, &lockFreeRef{ref.node, false}) {
+		atomic.StorePointer(&ref.node.prev, unsafe.Pointer(pred))
+		atomic.AddInt64(&l.length, -1)
+		return true
+	}
+	return false
+}
+
+// remove marks the node and attempts to unlink it using its prev hint. If the
+// hint is stale the node is left for Evict or Clean to unlink.
+func (l *LockFreeList) remove(node *LockFreeNode) {
+	if node.mark() {
+		l.unlink((*LockFreeNode)(atomic.LoadPointer(&node.prev)), node)
+	}
+}
+
+// Offer moves the entry to the tail of the list (MRU position).
+func (l *LockFreeList) Offer(entry *LockFreeEntry) {
+	node := &LockFreeNode{key: entry.value.Key, entry: entry}
+	l.append(node)
+
+	for {
+		old := atomic.LoadPointer(&entry.node)
+		if old == unsafe.Pointer(lockFreeRemoved) {
+			// entry was removed while appending
+			l.remove(node)
+			return
+		}
+		if atomic.CompareAndSwapPointer(&entry.node, old, unsafe.Pointer(node)) {
+			if old != nil {
+				l.remove((*LockFreeNode)(old))
+			}
+			return
+		}
+	}
+}
+
+// live returns true if the node is the current position of its entry.
+func (n *LockFreeNode) live() bool {
+	return !n.load().marked &&
+		atomic.LoadPointer(&n.entry.node) == unsafe.Pointer(n)
+}
+
+// Candidate returns the key of the least recently used entry.
 func (l *LockFreeList) Candidate() string {
+	for node := l.head.load().node; node != nil; node = node.load().node {
+		if node.live() {
+			return node.key
+		}
+	}
 	return ""
 }
 
+// Clean unlinks every marked node in the list.
 func (l *LockFreeList) Clean() {
+	pred := l.head
+	for {
+		node := pred.load().node
+		if node == nil {
+			return
+		}
+		// stay on the same predecessor if node was unlinked
+		if node.load().marked && l.unlink(pred, node) {
+			continue
+		}
+		pred = node
+	}
 }
 
-func (l *LockFreeList) Delete(key string) {
+// Delete removes the entry from the list, any further Offers are ignored.
+func (l *LockFreeList) Delete(entry *LockFreeEntry) {
+	for {
+		old := atomic.LoadPointer(&entry.node)
+		if old == unsafe.Pointer(lockFreeRemoved) {
+			return
+		}
+		if atomic.CompareAndSwapPointer(
+			&entry.node, old, unsafe.Pointer(lockFreeRemoved)) {
+			if old != nil {
+				l.remove((*LockFreeNode)(old))
+			}
+			return
+		}
+	}
 }
 
+// Evict removes up to victims entries from the head of the list (LRU position)
+// and returns their keys.
 func (l *LockFreeList) Evict(victims int) []string {
-	return nil
+	keys := make([]string, 0, victims)
+
+	pred := l.head
+	for len(keys) < victims {
+		node := pred.load().node
+		if node == nil {
+			break
+		}
+
+		// claim the entry if this is its current position, otherwise it's a
+		// stale node that's about to be marked
+		if !node.load().marked && atomic.CompareAndSwapPointer(
+			&node.entry.node,
+			unsafe.Pointer(node),
+			unsafe.Pointer(lockFreeRemoved),
+		) {
+			keys = append(keys, node.key)
+			node.mark()
+		}
+
+		// stay on the same predecessor if node was unlinked
+		if node.load().marked && l.unlink(pred, node) {
+			continue
+		}
+		pred = node
+	}
+
+	return keys
 }
 
 func NewLockFreeCache(size int) *LockFreeCache {
 	return &LockFreeCache{
-		data: make(map[string]atomic.Value),
-		lru:  &LockFreeList{},
-		size: size,
+		data:   &sync.Map{},
+		lru:    NewLockFreeList(),
+		expiry: wheel.NewWheel(wheel.GRANULARITY),
+		stats:  stats.NewRecorder(),
+		size:   size,
 	}
 }
 
 func (c *LockFreeCache) Get(key string) *Value {
-	node, exists := c.data[key]
+	raw, exists := c.data.Load(key)
 	if !exists {
+		c.stats.Get(false)
 		return nil
 	}
 
-	// atomically load and make sure != nil before conversion
-	data := node.Load()
-	if data == nil {
+	// expired entries are misses until the timer wheel removes them
+	entry := raw.(*LockFreeEntry)
+	if wheel.IsExpired(entry.expiration) {
+		c.stats.Get(false)
 		return nil
 	}
-
-	value := data.(*Value)
+	c.stats.Get(true)
 
 	// offer value to the tail of list (MRU position)
-	c.lru.Offer(key)
+	c.lru.Offer(entry)
 
-	return value
+	return entry.value
 }
 
 func (c *LockFreeCache) Set(key string, data interface{}) {
+	c.set(key, data, 0)
+}
+
+// SetWithTTL is like Set but the element expires after ttl.
+func (c *LockFreeCache) SetWithTTL(key string, data interface{}, ttl time.Duration) bool {
+	return c.set(key, data, ttl)
+}
+
+func (c *LockFreeCache) set(key string, data interface{}, ttl time.Duration) bool {
 	c.Lock()
-	defer c.Unlock()
+	added := c.add(key, data, ttl)
+	delivery := c.notify.Flush()
+	c.Unlock()
 
-	if _, exists := c.data[key]; exists {
-		return
+	delivery.Deliver()
+	return added
+}
+
+func (c *LockFreeCache) add(key string, data interface{}, ttl time.Duration) bool {
+	// existing entries are replaced by a new one rather than modified, Get
+	// reads entries without locking
+	if raw, exists := c.data.Load(key); exists {
+		reason := removal.REPLACED
+		if wheel.IsExpired(raw.(*LockFreeEntry).expiration) {
+			reason = removal.EXPIRED
+		}
+		c.remove(key, raw.(*LockFreeEntry), reason)
+	}
+	c.stats.Set(1, true)
+
+	// create new entry and save to map
+	entry := &LockFreeEntry{value: &Value{key, data}, expiration: wheel.Expiration(ttl)}
+	c.data.Store(key, entry)
+	c.count++
+	if entry.expiration != 0 {
+		c.start.Do(func() { c.expiry.Start(c.expire) })
+		c.expiry.Add(key, entry.expiration)
 	}
 
 	// offer value to tail of list (MRU position)
-	c.lru.Offer(key)
+	c.lru.Offer(entry)
 
 	// check if eviction needed
-	if len(c.data) >= c.size {
-		victims := c.lru.Evict(len(c.data) - c.size)
+	if c.count > c.size {
+		victims := c.lru.Evict(c.count - c.size)
 		// delete victims from map
 		for _, victim := range victims {
-			delete(c.data, victim)
+			if raw, exists := c.data.Load(victim); exists {
+				entry := raw.(*LockFreeEntry)
+				c.expiry.Del(victim, entry.expiration)
+				c.notify.Add(victim, entry.value.Data, removal.SIZE)
+			}
+			c.data.Delete(victim)
+			c.count--
+			c.stats.Evict(stats.SIZE, 1)
 		}
 	}
 
-	// create new atomic value and save to map
-	var value atomic.Value
-	value.Store(&Value{key, data})
-	c.data[key] = value
+	// unlink the marked nodes left behind by Offer once they start piling up
+	if c.lru.Len() > c.size*2 {
+		c.lru.Clean()
+	}
+	return true
 }
 
-func (c *LockFreeCache) Del(key string) {
+// remove deletes the entry from the map and the list. This should only be
+// called while holding the lock.
+func (c *LockFreeCache) remove(key string, entry *LockFreeEntry, reason RemovalReason) {
+	c.data.Delete(key)
+	c.lru.Delete(entry)
+	c.expiry.Del(key, entry.expiration)
+	c.count--
+
+	record(c.stats, reason, 1)
+	c.notify.Add(key, entry.value.Data, reason)
+}
+
+// expire is called by the timer wheel with keys that may have expired.
+func (c *LockFreeCache) expire(keys []string) {
 	c.Lock()
-	defer c.Unlock()
+	for _, key := range keys {
+		if raw, exists := c.data.Load(key); exists &&
+			wheel.IsExpired(raw.(*LockFreeEntry).expiration) {
+			c.remove(key, raw.(*LockFreeEntry), removal.EXPIRED)
+		}
+	}
+	delivery := c.notify.Flush()
+	c.Unlock()
 
-	if _, exists := c.data[key]; !exists {
-		return
+	delivery.Deliver()
+}
+
+// Close stops the background expiration goroutine.
+func (c *LockFreeCache) Close() {
+	c.expiry.Stop()
+}
+
+func (c *LockFreeCache) Del(key string) {
+	c.Lock()
+	if raw, exists := c.data.Load(key); exists {
+		c.remove(key, raw.(*LockFreeEntry), removal.EXPLICIT)
 	}
+	delivery := c.notify.Flush()
+	c.Unlock()
 
-	delete(c.data, key)
-	c.lru.Delete(key)
+	delivery.Deliver()
+}
+
+// OnEvict sets the listener called with every removed element.
+func (c *LockFreeCache) OnEvict(listener RemovalListener) {
+	c.Lock()
+	defer c.Unlock()
+	c.notify.Listen(listener)
+}
+
+func (c *LockFreeCache) Stats() Stats {
+	return c.stats.Snapshot()
 }
 
 func (c *LockFreeCache) candidate() string {
@@ -306,6 +1394,262 @@ func (c *LockFreeCache) candidate() string {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+const (
+	// SHARD_BUFFER is the capacity of each stripe in the ShardedCache access
+	// buffer (BP-Wrapper batch size).
+	SHARD_BUFFER = 64
+)
+
+type (
+	ShardedCacheItem struct {
+		Value      *Value
+		Expiration int64
+	}
+
+	ShardedCacheShard struct {
+		sync.RWMutex
+		data   map[string]*list.Element
+		lru    *list.List
+		lruMu  sync.Mutex
+		notify removal.Notifier
+		size   int
+	}
+
+	// ShardedCache partitions keys across a power of two number of shards,
+	// each with its own map and LRU list. Accesses are recorded in a shared
+	// LOSSLESS ring buffer and applied to the shards' LRU lists in batches, so
+	// hot keys on a single shard don't contend on the list (see the BP-Wrapper
+	// notes in the README).
+	ShardedCache struct {
+		shards []*ShardedCacheShard
+		mask   uint64
+		access *ring.Buffer
+		expiry *wheel.Wheel
+		start  sync.Once
+		stats  *stats.Recorder
+	}
+)
+
+// NewShardedCache returns a cache with size split evenly across the shards.
+// The number of shards is rounded up to a power of two, and halved while
+// there are more shards than elements.
+func NewShardedCache(size, shards int) *ShardedCache {
+	count := int(util.Near(uint64(shards)))
+	for count > 1 && count > size {
+		count >>= 1
+	}
+
+	cache := &ShardedCache{
+		shards: make([]*ShardedCacheShard, count),
+		mask:   uint64(count - 1),
+		expiry: wheel.NewWheel(wheel.GRANULARITY),
+		stats:  stats.NewRecorder(),
+	}
+	for i := range cache.shards {
+		// the first size%count shards hold the remainder
+		shardSize := size / count
+		if i < size%count {
+			shardSize++
+		}
+		cache.shards[i] = &ShardedCacheShard{
+			data: make(map[string]*list.Element, shardSize),
+			lru:  list.New(),
+			size: shardSize,
+		}
+	}
+	cache.access = ring.NewBuffer(ring.LOSSLESS, &ring.Config{
+		Consumer: cache,
+		Stripes:  int(util.Near(uint64(runtime.GOMAXPROCS(0)))),
+		Capacity: SHARD_BUFFER,
+	})
+	return cache
+}
+
+func (c *ShardedCache) shard(key string) *ShardedCacheShard {
+	return c.shards[util.Hash64([]byte(key))&c.mask]
+}
+
+// Push is called by the access buffer when a stripe is drained. Keys are
+// grouped by shard so each LRU lock is only acquired once per batch.
+func (c *ShardedCache) Push(keys []ring.Element) {
+	batches := make([][]string, len(c.shards))
+	for _, key := range keys {
+		id := util.Hash64([]byte(key)) & c.mask
+		batches[id] = append(batches[id], string(key))
+	}
+
+	for id, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+
+		shard := c.shards[id]
+		shard.RLock()
+		shard.lruMu.Lock()
+		for _, key := range batch {
+			if element, exists := shard.data[key]; exists {
+				shard.lru.MoveToFront(element)
+			}
+		}
+		shard.lruMu.Unlock()
+		shard.RUnlock()
+	}
+}
+
+func (c *ShardedCache) Get(key string) *Value {
+	shard := c.shard(key)
+
+	shard.RLock()
+	element, exists := shard.data[key]
+	if !exists {
+		shard.RUnlock()
+		c.stats.Get(false)
+		return nil
+	}
+	item := element.Value.(*ShardedCacheItem)
+	shard.RUnlock()
+
+	// expired elements are misses until the timer wheel removes them
+	if wheel.IsExpired(item.Expiration) {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
+
+	// record access in buffer, this is done after unlocking because the buffer
+	// may drain and need the shard lock
+	c.access.Push(ring.Element(key))
+
+	return item.Value
+}
+
+func (c *ShardedCache) Set(key string, data interface{}) {
+	c.SetWithTTL(key, data, 0)
+}
+
+// SetWithTTL is like Set but the element expires after ttl.
+func (c *ShardedCache) SetWithTTL(key string, data interface{}, ttl time.Duration) bool {
+	shard := c.shard(key)
+
+	shard.Lock()
+	added := c.set(shard, key, data, wheel.Expiration(ttl))
+	delivery := shard.notify.Flush()
+	shard.Unlock()
+
+	delivery.Deliver()
+	return added
+}
+
+func (c *ShardedCache) set(shard *ShardedCacheShard, key string, data interface{}, expiration int64) bool {
+	shard.lruMu.Lock()
+	defer shard.lruMu.Unlock()
+	if shard.size < 1 {
+		c.stats.Set(1, false)
+		return false
+	}
+	c.stats.Set(1, true)
+
+	item := &ShardedCacheItem{&Value{key, data}, expiration}
+	if element, exists := shard.data[key]; exists {
+		// element already exists, update the value
+		old := element.Value.(*ShardedCacheItem)
+		c.expiry.Del(key, old.Expiration)
+		shard.notify.Add(key, old.Value.Data, removal.REPLACED)
+		element.Value = item
+		shard.lru.MoveToFront(element)
+	} else {
+		// check if eviction is needed
+		if shard.lru.Len() >= shard.size {
+			c.remove(shard, shard.lru.Back(), removal.SIZE)
+		}
+		shard.data[key] = shard.lru.PushFront(item)
+	}
+
+	if expiration != 0 {
+		c.start.Do(func() { c.expiry.Start(c.expire) })
+		c.expiry.Add(key, expiration)
+	}
+	return true
+}
+
+// remove should be called while holding both of the shard's locks.
+func (c *ShardedCache) remove(shard *ShardedCacheShard, element *list.Element, reason RemovalReason) {
+	item := element.Value.(*ShardedCacheItem)
+	shard.lru.Remove(element)
+	delete(shard.data, item.Value.Key)
+	c.expiry.Del(item.Value.Key, item.Expiration)
+
+	record(c.stats, reason, 1)
+	shard.notify.Add(item.Value.Key, item.Value.Data, reason)
+}
+
+// expire is called by the timer wheel with keys that may have expired.
+func (c *ShardedCache) expire(keys []string) {
+	for _, key := range keys {
+		shard := c.shard(key)
+
+		shard.Lock()
+		if element, exists := shard.data[key]; exists &&
+			wheel.IsExpired(element.Value.(*ShardedCacheItem).Expiration) {
+			shard.lruMu.Lock()
+			c.remove(shard, element, removal.EXPIRED)
+			shard.lruMu.Unlock()
+		}
+		delivery := shard.notify.Flush()
+		shard.Unlock()
+
+		delivery.Deliver()
+	}
+}
+
+// Close stops the background expiration goroutine.
+func (c *ShardedCache) Close() {
+	c.expiry.Stop()
+}
+
+func (c *ShardedCache) Del(key string) {
+	shard := c.shard(key)
+
+	shard.Lock()
+	if element, exists := shard.data[key]; exists {
+		shard.lruMu.Lock()
+		c.remove(shard, element, removal.EXPLICIT)
+		shard.lruMu.Unlock()
+	}
+	delivery := shard.notify.Flush()
+	shard.Unlock()
+
+	delivery.Deliver()
+}
+
+// OnEvict sets the listener called with every removed element.
+func (c *ShardedCache) OnEvict(listener RemovalListener) {
+	for _, shard := range c.shards {
+		shard.Lock()
+		shard.notify.Listen(listener)
+		shard.Unlock()
+	}
+}
+
+func (c *ShardedCache) Stats() Stats {
+	return c.stats.Snapshot(c.access)
+}
+
+// candidate returns the victim of the first shard, which is the only victim
+// when there's a single shard, or "" if the shard is empty.
+func (c *ShardedCache) candidate() string {
+	shard := c.shards[0]
+
+	shard.lruMu.Lock()
+	defer shard.lruMu.Unlock()
+	if shard.lru.Len() == 0 {
+		return ""
+	}
+	return shard.lru.Back().Value.(*ShardedCacheItem).Value.Key
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 type (
 	SampledValue struct {
 		Value *Value
@@ -313,8 +1657,9 @@ type (
 	}
 
 	SampledCache struct {
-		key  []byte
-		data map[string]*Value
+		key   []byte
+		data  map[string]*Value
+		stats *stats.Recorder
 	}
 )
 
@@ -326,7 +1671,8 @@ func NewSampledCache(size int) *SampledCache {
 			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 		},
-		data: make(map[string]*Value),
+		data:  make(map[string]*Value),
+		stats: stats.NewRecorder(),
 	}
 }
 
@@ -334,10 +1680,13 @@ func (c *SampledCache) Get(key string) *Value {
 	//hash := highwayhash.Sum64([]byte(key), c.key)
 	//atomic.LoadUint64(&hash)
 
-	return c.data[key]
+	value := c.data[key]
+	c.stats.Get(value != nil)
+	return value
 }
 
 func (c *SampledCache) Set(key string, data interface{}) {
+	c.stats.Set(1, true)
 	c.data[key] = &Value{key, data}
 }
 
@@ -345,6 +1694,10 @@ func (c *SampledCache) Del(key string) {
 	delete(c.data, key)
 }
 
+func (c *SampledCache) Stats() Stats {
+	return c.stats.Snapshot()
+}
+
 func (c *SampledCache) candidate() string {
 	return ""
 }
@@ -357,28 +1710,33 @@ type (
 		Count uint64
 	}
 	SyncMap struct {
-		data *sync.Map
+		data  *sync.Map
+		stats *stats.Recorder
 	}
 )
 
 func NewSyncMap(size int) *SyncMap {
 	return &SyncMap{
-		data: &sync.Map{},
+		data:  &sync.Map{},
+		stats: stats.NewRecorder(),
 	}
 }
 
 func (c *SyncMap) Get(key string) *Value {
 	raw, _ := c.data.Load(key)
 	if raw == nil {
+		c.stats.Get(false)
 		return nil
 	}
+	c.stats.Get(true)
 
 	value := raw.(*SyncMapValue)
-	value.Count++
+	atomic.AddUint64(&value.Count, 1)
 	return value.Value
 }
 
 func (c *SyncMap) Set(key string, data interface{}) {
+	c.stats.Set(1, true)
 	c.data.Store(key, &SyncMapValue{
 		Value: &Value{key, data},
 		Count: 0,
@@ -389,6 +1747,10 @@ func (c *SyncMap) Del(key string) {
 	c.data.Delete(key)
 }
 
+func (c *SyncMap) Stats() Stats {
+	return c.stats.Snapshot()
+}
+
 func (c *SyncMap) candidate() string {
 	return ""
 }
@@ -401,6 +1763,7 @@ type (
 		buffer *ring.Buffer
 		data   *sync.Map
 		counts map[string]uint64
+		stats  *stats.Recorder
 	}
 )
 
@@ -408,6 +1771,7 @@ func NewSyncMapWrap(size int) *SyncMapWrap {
 	cache := &SyncMapWrap{
 		data:   &sync.Map{},
 		counts: make(map[string]uint64, size),
+		stats:  stats.NewRecorder(),
 	}
 	cache.buffer = ring.NewBuffer(ring.LOSSY, &ring.Config{
 		Consumer: cache,
@@ -425,12 +1789,18 @@ func (c *SyncMapWrap) Push(keys []ring.Element) {
 }
 
 func (c *SyncMapWrap) Get(key string) *Value {
-	value, _ := c.data.Load(key)
+	value, ok := c.data.Load(key)
+	if !ok {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
 	c.buffer.Push(ring.Element(key))
 	return value.(*Value)
 }
 
 func (c *SyncMapWrap) Set(key string, data interface{}) {
+	c.stats.Set(1, true)
 	c.data.Store(key, &Value{key, data})
 }
 
@@ -438,6 +1808,10 @@ func (c *SyncMapWrap) Del(key string) {
 	c.data.Delete(key)
 }
 
+func (c *SyncMapWrap) Stats() Stats {
+	return c.stats.Snapshot(c.buffer)
+}
+
 func (c *SyncMapWrap) candidate() string {
 	return ""
 }
@@ -445,74 +1819,189 @@ func (c *SyncMapWrap) candidate() string {
 ////////////////////////////////////////////////////////////////////////////////
 
 type (
+	// FastCache adapts fastcache, which stores []byte values in large chunks
+	// of memory the GC doesn't scan. Values are encoded (see encodeValue) and
+	// whole chunks are dropped when it's full, so evictions aren't counted.
 	FastCache struct {
 		cache *fastcache.Cache
+		codec codec.Codec
+		stats *stats.Recorder
 	}
 )
 
+// NewFastCache returns a FastCache using at most size bytes (fastcache rounds
+// it up to at least 32MB).
 func NewFastCache(size int) *FastCache {
+	return NewFastCacheCodec(size, codec.Gob{})
+}
+
+// NewFastCacheCodec is like NewFastCache with a codec for values that aren't
+// []byte or string.
+func NewFastCacheCodec(size int, c codec.Codec) *FastCache {
 	return &FastCache{
 		cache: fastcache.New(size),
+		codec: c,
+		stats: stats.NewRecorder(),
 	}
 }
 
+// Get returns nil on a miss or if the value can't be decoded.
 func (c *FastCache) Get(key string) *Value {
-	data := make([]byte, 1)
-	c.cache.Get(data, []byte(key))
+	b := c.cache.Get(nil, util.Bytes(key))
+	if len(b) == 0 {
+		c.stats.Get(false)
+		return nil
+	}
+	data, err := decodeValue(c.codec, b)
+	if err != nil {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
 	return &Value{key, data}
 }
 
+// Set rejects values the codec fails on.
 func (c *FastCache) Set(key string, data interface{}) {
-	// TODO
-	c.cache.Set([]byte(key), nil)
+	b, err := encodeValue(c.codec, data)
+	if err != nil {
+		c.stats.Set(1, false)
+		return
+	}
+	c.stats.Set(1, true)
+	c.cache.Set(util.Bytes(key), b)
 }
 
 func (c *FastCache) Del(key string) {
-	// TODO
+	c.cache.Del(util.Bytes(key))
 }
 
-func (c *FastCache) candidate() string {
-	// TODO
-	return ""
+// GetBytes doesn't allocate, the value is copied straight into dst. Values
+// set with Set are returned as stored (the codec's output for types other
+// than []byte and string).
+func (c *FastCache) GetBytes(dst, key []byte) ([]byte, bool) {
+	n := len(dst)
+	dst = c.cache.Get(dst, key)
+	// every stored value starts with its kind
+	if len(dst) == n {
+		c.stats.Get(false)
+		return dst, false
+	}
+	c.stats.Get(true)
+	copy(dst[n:], dst[n+1:])
+	return dst[:len(dst)-1], true
+}
+
+func (c *FastCache) SetBytes(key, value []byte) {
+	c.stats.Set(1, true)
+	setBytes(value, func(b []byte) { c.cache.Set(key, b) })
+}
+
+func (c *FastCache) DelBytes(key []byte) {
+	c.cache.Del(key)
+}
+
+func (c *FastCache) Stats() Stats {
+	return c.stats.Snapshot()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// BIGCACHE_LIFE is how long bigcache keeps entries before they can be evicted
+// by new ones, regardless of space.
+const BIGCACHE_LIFE = 10 * time.Minute
+
 type (
+	// BigCache adapts bigcache, which stores []byte values in byte queues
+	// the GC doesn't scan. Values are encoded (see encodeValue) and the oldest
+	// entries are dropped when it's full, so evictions aren't counted.
 	BigCache struct {
 		cache *bigcache.BigCache
+		codec codec.Codec
+		stats *stats.Recorder
 	}
 )
 
+// NewBigCache returns a BigCache using at most size bytes (rounded up to a
+// whole MB).
 func NewBigCache(size int) *BigCache {
-	bc, err := bigcache.NewBigCache(
-		bigcache.DefaultConfig(time.Second * 30),
-	)
+	return NewBigCacheCodec(size, codec.Gob{})
+}
+
+// NewBigCacheCodec is like NewBigCache with a codec for values that aren't
+// []byte or string.
+func NewBigCacheCodec(size int, c codec.Codec) *BigCache {
+	config := bigcache.DefaultConfig(BIGCACHE_LIFE)
+	config.HardMaxCacheSize = (size + 1<<20 - 1) >> 20
+	// don't preallocate more than the limit
+	config.MaxEntriesInWindow = size / config.MaxEntrySize
+	config.Verbose = false
+
+	bc, err := bigcache.NewBigCache(config)
 	if err != nil {
 		panic(err)
 	}
 	return &BigCache{
 		cache: bc,
+		codec: c,
+		stats: stats.NewRecorder(),
 	}
 }
 
+// Get returns nil on a miss or if the value can't be decoded.
 func (c *BigCache) Get(key string) *Value {
-	data, _ := c.cache.Get(key)
+	b, err := c.cache.Get(key)
+	if err != nil {
+		c.stats.Get(false)
+		return nil
+	}
+	data, err := decodeValue(c.codec, b)
+	if err != nil {
+		c.stats.Get(false)
+		return nil
+	}
+	c.stats.Get(true)
 	return &Value{key, data}
 }
 
+// Set rejects values the codec fails on and values too big for a shard.
 func (c *BigCache) Set(key string, data interface{}) {
-	// TODO
-	if err := c.cache.Set(key, nil); err != nil {
-		panic(err)
+	b, err := encodeValue(c.codec, data)
+	if err == nil {
+		err = c.cache.Set(key, b)
 	}
+	c.stats.Set(1, err == nil)
 }
 
 func (c *BigCache) Del(key string) {
-	// TODO
+	c.cache.Delete(key)
 }
 
-func (c *BigCache) candidate() string {
-	// TODO
-	return ""
+// GetBytes passes the key to bigcache without copying, but bigcache itself
+// allocates a copy of every value it returns (there's no way to read an entry
+// in place), so unlike the other caches a hit allocates once. Values set with Set are returned
+// as stored (the codec's output for types other than []byte and string).
+func (c *BigCache) GetBytes(dst, key []byte) ([]byte, bool) {
+	b, err := c.cache.Get(util.String(key))
+	if err != nil || len(b) == 0 {
+		c.stats.Get(false)
+		return dst, false
+	}
+	c.stats.Get(true)
+	return append(dst, b[1:]...), true
+}
+
+func (c *BigCache) SetBytes(key, value []byte) {
+	var err error
+	// bigcache copies the key into its own entry
+	setBytes(value, func(b []byte) { err = c.cache.Set(util.String(key), b) })
+	c.stats.Set(1, err == nil)
+}
+
+func (c *BigCache) DelBytes(key []byte) {
+	c.cache.Delete(util.String(key))
+}
+
+func (c *BigCache) Stats() Stats {
+	return c.stats.Snapshot()
 }
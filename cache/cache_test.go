@@ -1,12 +1,20 @@
 package cache
 
 import (
+	"encoding/gob"
 	"fmt"
 	"math/rand"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/xba/stress"
+	"github.com/karlmcguire/experiments-cache/pkg/codec"
+	"github.com/karlmcguire/experiments-cache/pkg/hdr"
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+	"github.com/karlmcguire/experiments-cache/pkg/store"
+	"github.com/karlmcguire/experiments-cache/workload"
 )
 
 const (
@@ -20,31 +28,25 @@ func init() {
 }
 
 func zipfKeys() []string {
-	size := uint64(KEYS)
-	keys := make([]string, size)
-	zipf := stress.GenerateZipf(2.1, 1, size)
-
-	i := 0
-	for n, err := zipf(); err != stress.ErrDone; n, err = zipf() {
-		keys[i] = fmt.Sprintf("%d", n)
-	}
-
-	return keys
+	return workload.Keys(workload.NewZipf(1, 2.1, KEYS), KEYS)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// TestCache is implemented by caches evicting entries one at a time in LRU
+// order, so GenerateTests can check which key is next.
 type TestCache interface {
 	Cache
 	candidate() string
 }
 
-func GenerateTests(create func() TestCache) func(t *testing.T) {
+func GenerateTests(create func() Cache) func(t *testing.T) {
 	return func(t *testing.T) {
 		cache := create()
 
 		cache.Set("1", 1)
-		if cache.Get("1").Key != "1" {
+		if value := cache.Get("1"); value == nil || value.Key != "1" ||
+			value.Data.(int) != 1 {
 			t.Fatal("set/get error")
 		}
 
@@ -57,18 +59,672 @@ func GenerateTests(create func() TestCache) func(t *testing.T) {
 			cache.Set(fmt.Sprintf("%d", i), i)
 		}
 
-		if cache.candidate() != fmt.Sprintf("%d", CACHE_SIZE) {
+		stats := cache.Stats()
+		if stats.Hits != 1 || stats.Misses != 1 {
+			t.Fatal("stats get error")
+		}
+		if stats.Sets != CACHE_SIZE*2+1 {
+			t.Fatal("stats set error")
+		}
+
+		c, ok := cache.(TestCache)
+		if !ok {
+			return
+		}
+		if c.candidate() != fmt.Sprintf("%d", CACHE_SIZE) {
 			t.Fatal("eviction error")
 		}
+		if stats.TotalEvictions() != CACHE_SIZE {
+			t.Fatal("stats eviction error")
+		}
 	}
 }
 
 func TestMapCache(t *testing.T) {
-	GenerateTests(func() TestCache { return NewMapCache(CACHE_SIZE) })(t)
+	GenerateTests(func() Cache { return NewMapCache(CACHE_SIZE) })(t)
 }
 
 func TestMapWrapCache(t *testing.T) {
-	GenerateTests(func() TestCache { return NewMapWrapCache(CACHE_SIZE) })(t)
+	GenerateTests(func() Cache { return NewMapWrapCache(CACHE_SIZE) })(t)
+}
+
+func TestLockFreeCache(t *testing.T) {
+	GenerateTests(func() Cache { return NewLockFreeCache(CACHE_SIZE) })(t)
+}
+
+func TestLockFreeCacheConcurrent(t *testing.T) {
+	cache := NewLockFreeCache(CACHE_SIZE)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < KEYS/8; i++ {
+				key := fmt.Sprintf("%d", rand.Intn(CACHE_SIZE*4))
+				switch i % 8 {
+				case 0, 1:
+					cache.Set(key, i)
+				case 2:
+					cache.Del(key)
+				default:
+					cache.Get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if cache.count > CACHE_SIZE {
+		t.Fatal("capacity error")
+	}
+
+	// the last node is never unlinked, even if it's marked
+	cache.lru.Clean()
+	if cache.lru.Len() < cache.count || cache.lru.Len() > cache.count+1 {
+		t.Fatal("list doesn't match cache")
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	// a single shard should behave exactly like an LRU cache
+	GenerateTests(func() Cache { return NewShardedCache(CACHE_SIZE, 1) })(t)
+}
+
+func TestShardedCacheConcurrent(t *testing.T) {
+	cache := NewShardedCache(CACHE_SIZE, 4)
+	if cache.candidate() != "" {
+		t.Fatal("expected no candidate in an empty shard")
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < KEYS/8; i++ {
+				key := fmt.Sprintf("%d", rand.Intn(CACHE_SIZE*4))
+				switch i % 8 {
+				case 0, 1:
+					cache.Set(key, i)
+				case 2:
+					cache.Del(key)
+				default:
+					cache.Get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, shard := range cache.shards {
+		if len(shard.data) > shard.size || shard.lru.Len() != len(shard.data) {
+			t.Fatal("shard doesn't match its list")
+		}
+	}
+}
+
+func TestShardedCacheShards(t *testing.T) {
+	cache := NewShardedCache(CACHE_SIZE, 6)
+	if len(cache.shards) != 8 {
+		t.Fatal("shard count not rounded to power of two")
+	}
+
+	for i := 0; i < CACHE_SIZE*4; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	// read keys enough to drain the access buffer
+	for i := 0; i < SHARD_BUFFER*16; i++ {
+		cache.Get(fmt.Sprintf("%d", CACHE_SIZE*4-1-i%CACHE_SIZE))
+	}
+
+	for _, shard := range cache.shards {
+		if len(shard.data) > CACHE_SIZE/8 || shard.lru.Len() != len(shard.data) {
+			t.Fatal("shard capacity error")
+		}
+	}
+}
+
+func TestShardedCacheCapacity(t *testing.T) {
+	for _, test := range []struct{ size, shards, count int }{
+		{CACHE_SIZE + 3, 4, 4},
+		{3, 8, 2},
+		{1, 4, 1},
+		{0, 4, 1},
+	} {
+		cache := NewShardedCache(test.size, test.shards)
+		if len(cache.shards) != test.count {
+			t.Fatalf("%d shards for size %d, expected %d",
+				len(cache.shards), test.size, test.count)
+		}
+		total := 0
+		for _, shard := range cache.shards {
+			total += shard.size
+		}
+		if total != test.size {
+			t.Fatalf("capacity %d, expected %d", total, test.size)
+		}
+	}
+
+	if NewShardedCache(0, 1).SetWithTTL("1", 1, 0) {
+		t.Fatal("empty cache admitted an element")
+	}
+}
+
+func GenerateCostTests(create func(size uint64, cost CostFunc) CostCache) func(t *testing.T) {
+	return func(t *testing.T) {
+		cache := create(100, func(data interface{}) uint64 {
+			return uint64(len(data.([]byte)))
+		})
+
+		if cache.SetWithCost("big", nil, 101) {
+			t.Fatal("admitted element larger than cache")
+		}
+
+		// admission policies may reject some elements, but the cost should
+		// always match what's stored
+		stored := uint64(0)
+		for i := 0; i < 10; i++ {
+			cache.Set(fmt.Sprintf("%d", i), make([]byte, 10))
+		}
+		for i := 0; i < 10; i++ {
+			if cache.Get(fmt.Sprintf("%d", i)) != nil {
+				stored += 10
+			}
+		}
+		if stored == 0 || cache.Cost() != stored {
+			t.Fatal("cost error")
+		}
+
+		cache.Set("large", make([]byte, 50))
+		if cache.Cost() > 100 {
+			t.Fatal("over capacity")
+		}
+
+		cache.Del("large")
+		for i := 0; i < 10; i++ {
+			cache.Del(fmt.Sprintf("%d", i))
+		}
+		if cache.Cost() != 0 {
+			t.Fatal("del cost error")
+		}
+	}
+}
+
+func TestRemovalListener(t *testing.T) {
+	for name, create := range map[string]func() RemovalCache{
+		"MapCache":      func() RemovalCache { return NewMapCache(CACHE_SIZE) },
+		"MapWrapCache":  func() RemovalCache { return NewMapWrapCache(CACHE_SIZE) },
+		"WTinyLFU":      func() RemovalCache { return NewWTinyLFU(CACHE_SIZE) },
+		"LockFreeCache": func() RemovalCache { return NewLockFreeCache(CACHE_SIZE) },
+		"ShardedCache":  func() RemovalCache { return NewShardedCache(CACHE_SIZE, 4) },
+	} {
+		cache := create()
+		reasons := make(map[RemovalReason]int)
+		cache.OnEvict(func(key string, value interface{}, reason RemovalReason) {
+			if value.(int) != len(key) {
+				t.Fatalf("%s: wrong value for %s", name, key)
+			}
+			reasons[reason]++
+			// listeners are called outside the locks
+			cache.Get(key)
+		})
+
+		// values are the key lengths so the listener can check them
+		for i := 0; i < CACHE_SIZE*4; i++ {
+			key := fmt.Sprintf("%d", i)
+			cache.Set(key, len(key))
+		}
+		if reasons[removal.SIZE]+reasons[removal.REJECTED] == 0 {
+			t.Fatalf("%s: no evictions", name)
+		}
+
+		key := fmt.Sprintf("%d", CACHE_SIZE*4-1)
+		if cache.Get(key) != nil {
+			cache.Del(key)
+			if reasons[removal.EXPLICIT] != 1 {
+				t.Fatalf("%s: no explicit removal", name)
+			}
+		}
+	}
+}
+
+func TestRemovalListenerExpired(t *testing.T) {
+	cache := NewMapCache(CACHE_SIZE)
+	expired := make([]string, 0)
+	cache.OnEvict(func(key string, value interface{}, reason RemovalReason) {
+		if reason == removal.EXPIRED {
+			expired = append(expired, key)
+		}
+	})
+	defer cache.Close()
+
+	cache.SetWithTTL("1", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	cache.expire([]string{"1"})
+	if len(expired) != 1 || expired[0] != "1" {
+		t.Fatal("expired removal error")
+	}
+}
+
+func TestRemovalListenerReplaced(t *testing.T) {
+	for name, cache := range map[string]RemovalCache{
+		"MapCache":      NewMapCache(CACHE_SIZE),
+		"MapWrapCache":  NewMapWrapCache(CACHE_SIZE),
+		"WTinyLFU":      NewWTinyLFU(CACHE_SIZE),
+		"LockFreeCache": NewLockFreeCache(CACHE_SIZE),
+	} {
+		var old interface{}
+		cache.OnEvict(func(key string, value interface{}, reason RemovalReason) {
+			if reason == removal.REPLACED {
+				old = value
+			}
+		})
+
+		cache.Set("1", 1)
+		cache.Set("1", 2)
+		if old != 1 || cache.Get("1").Data != 2 {
+			t.Fatalf("%s: replaced removal error", name)
+		}
+	}
+}
+
+func TestMapCacheCost(t *testing.T) {
+	GenerateCostTests(func(size uint64, cost CostFunc) CostCache {
+		return NewMapCacheCost(size, cost)
+	})(t)
+}
+
+func TestMapWrapCacheCost(t *testing.T) {
+	GenerateCostTests(func(size uint64, cost CostFunc) CostCache {
+		return NewMapWrapCacheCost(size, 10, cost)
+	})(t)
+
+	// replacing a value only counts the new cost
+	cache := NewMapWrapCacheCost(100, 10, unitCost)
+	cache.SetWithCost("a", 1, 60)
+	cache.SetWithCost("b", 2, 30)
+	cache.SetWithCost("a", 3, 10)
+	if cache.Cost() != 40 || cache.Get("b") == nil {
+		t.Fatal("replace cost error")
+	}
+}
+
+func TestWTinyLFUCost(t *testing.T) {
+	GenerateCostTests(func(size uint64, cost CostFunc) CostCache {
+		return NewWTinyLFUCost(size, 10, cost)
+	})(t)
+}
+
+func GenerateTTLTests(create func() TTLCache, expire func(TTLCache, []string)) func(t *testing.T) {
+	return func(t *testing.T) {
+		cache := create()
+		defer cache.Close()
+
+		cache.SetWithTTL("1", 1, time.Millisecond)
+		cache.SetWithTTL("2", 2, time.Hour)
+		cache.Set("3", 3)
+		time.Sleep(time.Millisecond * 2)
+
+		if cache.Get("1") != nil {
+			t.Fatal("expired element returned")
+		}
+		if cache.Get("2") == nil || cache.Get("3") == nil {
+			t.Fatal("unexpired element missing")
+		}
+
+		// keys passed by the timer wheel should only be removed if they're
+		// actually expired
+		expire(cache, []string{"1", "2", "3"})
+		if cache.Get("2") == nil || cache.Get("3") == nil {
+			t.Fatal("unexpired element removed")
+		}
+
+		// expired elements don't keep the key from being set again
+		cache.SetWithTTL("4", 4, time.Millisecond)
+		time.Sleep(time.Millisecond * 2)
+		cache.Set("4", 5)
+		if value := cache.Get("4"); value == nil || value.Data != 5 {
+			t.Fatal("expired element not replaced")
+		}
+	}
+}
+
+func TestMapCacheTTL(t *testing.T) {
+	GenerateTTLTests(
+		func() TTLCache { return NewMapCache(CACHE_SIZE) },
+		func(c TTLCache, keys []string) {
+			c.(*MapCache).expire(keys)
+			if _, exists := c.(*MapCache).data["1"]; exists {
+				t.Fatal("expired element not removed")
+			}
+		},
+	)(t)
+}
+
+func TestMapWrapCacheTTL(t *testing.T) {
+	GenerateTTLTests(
+		func() TTLCache { return NewMapWrapCache(CACHE_SIZE) },
+		func(c TTLCache, keys []string) {
+			c.(*MapWrapCache).expire(keys)
+			if _, exists := c.(*MapWrapCache).data["1"]; exists {
+				t.Fatal("expired element not removed")
+			}
+		},
+	)(t)
+}
+
+func TestLockFreeCacheTTL(t *testing.T) {
+	GenerateTTLTests(
+		func() TTLCache { return NewLockFreeCache(CACHE_SIZE) },
+		func(c TTLCache, keys []string) {
+			c.(*LockFreeCache).expire(keys)
+			if _, exists := c.(*LockFreeCache).data.Load("1"); exists {
+				t.Fatal("expired element not removed")
+			}
+		},
+	)(t)
+}
+
+func TestShardedCacheTTL(t *testing.T) {
+	GenerateTTLTests(
+		func() TTLCache { return NewShardedCache(CACHE_SIZE, 4) },
+		func(c TTLCache, keys []string) {
+			c.(*ShardedCache).expire(keys)
+			if c.(*ShardedCache).Stats().Evictions[stats.EXPIRED] != 1 {
+				t.Fatal("expired element not removed")
+			}
+		},
+	)(t)
+}
+
+func TestWTinyLFUTTL(t *testing.T) {
+	GenerateTTLTests(
+		func() TTLCache { return NewWTinyLFU(CACHE_SIZE) },
+		func(c TTLCache, keys []string) {
+			c.(*WTinyLFU).expire(keys)
+			if c.(*WTinyLFU).Cost() != 2 {
+				t.Fatal("expired element not removed")
+			}
+		},
+	)(t)
+}
+
+func TestWTinyLFU(t *testing.T) {
+	cache := NewWTinyLFU(CACHE_SIZE)
+
+	cache.Set("1", 1)
+	if cache.Get("1").Key != "1" {
+		t.Fatal("set/get error")
+	}
+
+	cache.Del("1")
+	if cache.Get("1") != nil {
+		t.Fatal("del error")
+	}
+
+	// make a hot set that's accessed between scans
+	for i := 0; i < CACHE_SIZE/2; i++ {
+		cache.Set(fmt.Sprintf("hot%d", i), i)
+	}
+	for n := 0; n < 4; n++ {
+		for i := 0; i < CACHE_SIZE/2; i++ {
+			cache.Get(fmt.Sprintf("hot%d", i))
+		}
+	}
+
+	// scan through more keys than the cache can hold
+	for i := 0; i < CACHE_SIZE*4; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+
+	if len(cache.data) > CACHE_SIZE {
+		t.Fatal("capacity error")
+	}
+
+	hits := 0
+	for i := 0; i < CACHE_SIZE/2; i++ {
+		if cache.Get(fmt.Sprintf("hot%d", i)) != nil {
+			hits++
+		}
+	}
+	if hits < CACHE_SIZE/4 {
+		t.Fatalf("scan evicted hot set (%d hits)", hits)
+	}
+}
+
+func TestWTinyLFUStats(t *testing.T) {
+	cache := NewWTinyLFU(CACHE_SIZE)
+	for i := 0; i < CACHE_SIZE*2; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+		cache.Get(fmt.Sprintf("%d", i/2))
+	}
+
+	stats := cache.Stats()
+	if stats.Sets != CACHE_SIZE*2 || stats.Hits+stats.Misses != CACHE_SIZE*2 {
+		t.Fatal("stats count error")
+	}
+	if stats.Rejections+stats.TotalEvictions() != CACHE_SIZE {
+		t.Fatal("stats eviction error")
+	}
+	if stats.CostAdded-stats.CostEvicted != cache.Cost() {
+		t.Fatal("stats cost error")
+	}
+}
+
+func TestWTinyLFUClimb(t *testing.T) {
+	cache := NewWTinyLFU(CACHE_SIZE)
+	start := cache.windowSize
+
+	// recency-heavy workload where only the latest keys are read, the hit
+	// rate only takes off once the window holds them so give it a few climbs
+	for i := 0; i < CACHE_SIZE*CLIMB_SAMPLE*20; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+		cache.Get(fmt.Sprintf("%d", i-CACHE_SIZE/8))
+	}
+
+	if cache.windowSize <= start {
+		t.Fatal("window didn't grow")
+	}
+	if len(cache.data) > CACHE_SIZE {
+		t.Fatal("capacity error")
+	}
+}
+
+func TestWTinyLFUSmall(t *testing.T) {
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("size 0 accepted")
+			}
+		}()
+		NewWTinyLFU(0)
+	}()
+
+	cache := NewWTinyLFU(1)
+	for i := 0; i < CLIMB_SAMPLE*4; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+		cache.Get(fmt.Sprintf("%d", i))
+		if cache.windowSize != 1 || cache.protectedSize != 0 || len(cache.data) > 1 {
+			t.Fatal("region size error")
+		}
+	}
+}
+
+func TestWTinyLFUClimbRestart(t *testing.T) {
+	cache := NewWTinyLFU(CACHE_SIZE)
+	start := cache.windowSize
+	// enough accesses for 200 climbs
+	samples := 200 * CACHE_SIZE * CLIMB_SAMPLE
+
+	// a scan where only the latest keys are read again favors a large window,
+	// and is long enough for the step to decay to nothing
+	for i := 0; i < samples; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+		cache.Get(fmt.Sprintf("%d", i-CACHE_SIZE/8))
+	}
+	grown := cache.windowSize
+	if grown <= start {
+		t.Fatal("window didn't grow during the scan")
+	}
+
+	// a frequency skewed workload favors a small window
+	zipf := workload.NewZipf(1, 1.01, KEYS)
+	for i := 0; i < samples; i++ {
+		key := fmt.Sprintf("zipf-%d", zipf.Next())
+		if cache.Get(key) == nil {
+			cache.Set(key, i)
+		}
+	}
+	if cache.windowSize >= grown {
+		t.Fatal("window didn't shrink after the workload changed")
+	}
+}
+
+// GenerateBytesTests checks a BytesCache and that a hit allocates exactly
+// allocs times (0 for every cache but BigCache).
+func GenerateBytesTests(create func() BytesCache, allocs float64) func(t *testing.T) {
+	return func(t *testing.T) {
+		c := create()
+		key, value := []byte("key"), []byte("value")
+		c.SetBytes(key, value)
+		// the cache has its own copy
+		value[0] = 'V'
+
+		dst, ok := c.GetBytes([]byte("prefix "), key)
+		if !ok || string(dst) != "prefix value" {
+			t.Fatalf("get error: %q", dst)
+		}
+		if _, ok := c.GetBytes(nil, []byte("missing")); ok {
+			t.Fatal("miss error")
+		}
+		c.SetBytes([]byte("empty"), nil)
+		if dst, ok := c.GetBytes(nil, []byte("empty")); !ok || len(dst) != 0 {
+			t.Fatal("empty value error")
+		}
+		c.DelBytes(key)
+		if _, ok := c.GetBytes(nil, key); ok {
+			t.Fatal("del error")
+		}
+
+		c.SetBytes(key, value)
+		dst = make([]byte, 0, 64)
+		if n := testing.AllocsPerRun(100, func() {
+			c.GetBytes(dst[:0], key)
+		}); n != allocs {
+			t.Fatalf("expected %v allocations on a hit, got %v", allocs, n)
+		}
+	}
+}
+
+func TestFastCache(t *testing.T) {
+	GenerateTests(func() Cache { return NewFastCache(CACHE_SIZE) })(t)
+}
+
+func TestBigCache(t *testing.T) {
+	GenerateTests(func() Cache { return NewBigCache(CACHE_SIZE) })(t)
+}
+
+type point struct{ X, Y int }
+
+func init() {
+	gob.Register(point{})
+}
+
+func TestByteCacheValues(t *testing.T) {
+	for name, c := range map[string]Cache{
+		"fastcache": NewFastCache(CACHE_SIZE),
+		"bigcache":  NewBigCache(CACHE_SIZE),
+	} {
+		c.Set("bytes", []byte("b"))
+		c.Set("string", "s")
+		c.Set("point", point{1, 2})
+		c.Set("func", func() {})
+
+		if b, ok := c.Get("bytes").Data.([]byte); !ok || string(b) != "b" {
+			t.Fatalf("%s: []byte error", name)
+		}
+		if s, ok := c.Get("string").Data.(string); !ok || s != "s" {
+			t.Fatalf("%s: string error", name)
+		}
+		if p, ok := c.Get("point").Data.(point); !ok || p != (point{1, 2}) {
+			t.Fatalf("%s: encoded value error", name)
+		}
+		// gob can't encode functions
+		if c.Get("func") != nil || c.Stats().Rejections != 1 {
+			t.Fatalf("%s: encoder error", name)
+		}
+
+		// values set as bytes can be read either way
+		c.(BytesCache).SetBytes([]byte("raw"), []byte("r"))
+		if b, ok := c.Get("raw").Data.([]byte); !ok || string(b) != "r" {
+			t.Fatalf("%s: SetBytes error", name)
+		}
+		if b, ok := c.(BytesCache).GetBytes(nil, []byte("string")); !ok || string(b) != "s" {
+			t.Fatalf("%s: GetBytes error", name)
+		}
+	}
+}
+
+func TestByteCacheCodec(t *testing.T) {
+	for name, c := range map[string]Cache{
+		"fastcache": NewFastCacheCodec(CACHE_SIZE, codec.JSON{}),
+		"bigcache":  NewBigCacheCodec(CACHE_SIZE, codec.JSON{}),
+	} {
+		c.Set("point", point{1, 2})
+		// JSON doesn't keep types, so structs come back as maps
+		if p, ok := c.Get("point").Data.(map[string]interface{}); !ok || p["X"] != 1.0 {
+			t.Fatalf("%s: codec error", name)
+		}
+	}
+}
+
+// TestByteCacheTyped stores structs through codec.Typed, with the caches used
+// as stores.
+func TestByteCacheTyped(t *testing.T) {
+	for name, c := range map[string]BytesCache{
+		"fastcache": NewFastCache(CACHE_SIZE),
+		"bigcache":  NewBigCache(CACHE_SIZE),
+	} {
+		points := codec.NewTyped[point](store.FromBytes(c), codec.Binary{})
+		if err := points.Set("point", point{1, 2}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if p, err := points.Get("point"); err != nil || p != (point{1, 2}) {
+			t.Fatalf("%s: get error %v", name, err)
+		}
+		points.Del("point")
+		if _, err := points.Get("point"); err != store.ErrNoValue {
+			t.Fatalf("%s: expected ErrNoValue, got %v", name, err)
+		}
+	}
+}
+
+func TestMapWrapCacheBytes(t *testing.T) {
+	GenerateBytesTests(func() BytesCache { return NewMapWrapCache(CACHE_SIZE) }, 0)(t)
+}
+
+func TestFastCacheBytes(t *testing.T) {
+	GenerateBytesTests(func() BytesCache { return NewFastCache(CACHE_SIZE) }, 0)(t)
+}
+
+// bigcache copies values out of its shards on every Get
+func TestBigCacheBytes(t *testing.T) {
+	GenerateBytesTests(func() BytesCache { return NewBigCache(CACHE_SIZE) }, 1)(t)
+}
+
+// TestSetBytesAllocs checks that prefixing values with their kind doesn't
+// allocate, the caches copy the prefixed value.
+func TestSetBytesAllocs(t *testing.T) {
+	for name, c := range map[string]BytesCache{
+		"fastcache": NewFastCache(CACHE_SIZE),
+		"bigcache":  NewBigCache(CACHE_SIZE),
+	} {
+		key, value := []byte("key"), []byte("value")
+		if n := testing.AllocsPerRun(100, func() { c.SetBytes(key, value) }); n != 0 {
+			t.Fatalf("%s: expected no allocations, got %v", name, n)
+		}
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -140,6 +796,92 @@ func GenerateBenchmarksZipf(create func() Cache) func(b *testing.B) {
 	}
 }
 
+// GenerateBenchmarksLatency times every Get, Set and Del under parallel load
+// and reports the tail latencies alongside ns/op, which hides stalls.
+func GenerateBenchmarksLatency(create func() Cache) func(b *testing.B) {
+	return func(b *testing.B) {
+		keys := zipfKeys()
+		ops := []struct {
+			name string
+			do   func(Cache, string)
+		}{
+			{"get", func(cache Cache, key string) { cache.Get(key) }},
+			{"set", func(cache Cache, key string) { cache.Set(key, nil) }},
+			{"del", func(cache Cache, key string) { cache.Del(key) }},
+		}
+		for _, op := range ops {
+			do := op.do
+			b.Run(op.name, func(b *testing.B) {
+				cache := create()
+				for _, key := range keys {
+					cache.Set(key, nil)
+				}
+				var (
+					mu        sync.Mutex
+					histogram = hdr.New()
+				)
+
+				b.SetParallelism(PARA_MULTI)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					local := hdr.New()
+					index := rand.Int()
+
+					for pb.Next() {
+						start := time.Now()
+						do(cache, keys[index%len(keys)])
+						local.Record(time.Since(start))
+						index++
+					}
+
+					mu.Lock()
+					histogram.Merge(local)
+					mu.Unlock()
+				})
+				b.StopTimer()
+				reportLatency(b, histogram)
+			})
+		}
+	}
+}
+
+func reportLatency(b *testing.B, histogram *hdr.Histogram) {
+	b.ReportMetric(float64(histogram.Percentile(0.5)), "p50-ns")
+	b.ReportMetric(float64(histogram.Percentile(0.99)), "p99-ns")
+	b.ReportMetric(float64(histogram.Percentile(0.999)), "p999-ns")
+	b.ReportMetric(float64(histogram.Max()), "max-ns")
+}
+
+// GenerateBenchmarksBytes measures hits through GetBytes, reusing dst. It
+// fails if a hit doesn't allocate exactly allocs times.
+func GenerateBenchmarksBytes(create func() BytesCache, allocs float64) func(b *testing.B) {
+	return func(b *testing.B) {
+		c := create()
+		keys := make([][]byte, 1024)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("%d", i))
+			c.SetBytes(keys[i], keys[i])
+		}
+		dst := make([]byte, 0, 64)
+		if n := testing.AllocsPerRun(100, func() {
+			c.GetBytes(dst[:0], keys[0])
+		}); n != allocs {
+			b.Fatalf("expected %v allocations on a hit, got %v", allocs, n)
+		}
+
+		b.SetParallelism(PARA_MULTI)
+		b.SetBytes(1)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			dst := make([]byte, 0, 64)
+			for i := rand.Int(); pb.Next(); i++ {
+				dst, _ = c.GetBytes(dst[:0], keys[i&1023])
+			}
+		})
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func BenchmarkMapCache(b *testing.B) {
@@ -154,6 +896,12 @@ func BenchmarkMapCacheZipf(b *testing.B) {
 	})(b)
 }
 
+func BenchmarkMapCacheLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewMapCache(CACHE_SIZE)
+	})(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func BenchmarkMapWrapCache(b *testing.B) {
@@ -168,6 +916,78 @@ func BenchmarkMapWrapCacheZipf(b *testing.B) {
 	})(b)
 }
 
+func BenchmarkMapWrapCacheLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewMapWrapCache(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkMapWrapCacheBytes(b *testing.B) {
+	GenerateBenchmarksBytes(func() BytesCache {
+		return NewMapWrapCache(CACHE_SIZE)
+	}, 0)(b)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func BenchmarkWTinyLFU(b *testing.B) {
+	GenerateBenchmarks(func() Cache {
+		return NewWTinyLFU(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkWTinyLFUZipf(b *testing.B) {
+	GenerateBenchmarksZipf(func() Cache {
+		return NewWTinyLFU(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkWTinyLFULatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewWTinyLFU(CACHE_SIZE)
+	})(b)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func BenchmarkLockFreeCache(b *testing.B) {
+	GenerateBenchmarks(func() Cache {
+		return NewLockFreeCache(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkLockFreeCacheZipf(b *testing.B) {
+	GenerateBenchmarksZipf(func() Cache {
+		return NewLockFreeCache(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkLockFreeCacheLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewLockFreeCache(CACHE_SIZE)
+	})(b)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func BenchmarkShardedCache(b *testing.B) {
+	GenerateBenchmarks(func() Cache {
+		return NewShardedCache(CACHE_SIZE, runtime.GOMAXPROCS(0))
+	})(b)
+}
+
+func BenchmarkShardedCacheZipf(b *testing.B) {
+	GenerateBenchmarksZipf(func() Cache {
+		return NewShardedCache(CACHE_SIZE, runtime.GOMAXPROCS(0))
+	})(b)
+}
+
+func BenchmarkShardedCacheLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewShardedCache(CACHE_SIZE, runtime.GOMAXPROCS(0))
+	})(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func BenchmarkSyncMap(b *testing.B) {
@@ -182,6 +1002,12 @@ func BenchmarkSyncMapZipf(b *testing.B) {
 	})(b)
 }
 
+func BenchmarkSyncMapLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewSyncMap(CACHE_SIZE)
+	})(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func BenchmarkSyncMapWrap(b *testing.B) {
@@ -196,6 +1022,12 @@ func BenchmarkSyncMapWrapZipf(b *testing.B) {
 	})(b)
 }
 
+func BenchmarkSyncMapWrapLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewSyncMapWrap(CACHE_SIZE)
+	})(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func BenchmarkFastCache(b *testing.B) {
@@ -210,6 +1042,18 @@ func BenchmarkFastCacheZipf(b *testing.B) {
 	})(b)
 }
 
+func BenchmarkFastCacheLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewFastCache(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkFastCacheBytes(b *testing.B) {
+	GenerateBenchmarksBytes(func() BytesCache {
+		return NewFastCache(CACHE_SIZE)
+	}, 0)(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func BenchmarkBigCache(b *testing.B) {
@@ -224,4 +1068,16 @@ func BenchmarkBigCacheZipf(b *testing.B) {
 	})(b)
 }
 
+func BenchmarkBigCacheLatency(b *testing.B) {
+	GenerateBenchmarksLatency(func() Cache {
+		return NewBigCache(CACHE_SIZE)
+	})(b)
+}
+
+func BenchmarkBigCacheBytes(b *testing.B) {
+	GenerateBenchmarksBytes(func() BytesCache {
+		return NewBigCache(CACHE_SIZE)
+	}, 1)(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/karlmcguire/experiments-cache/pkg/codec"
+)
+
+// The first byte of a value stored by the caches holding []byte, like
+// FastCache and BigCache. []byte and string values are stored as is, the
+// codec is only used for other types.
+const (
+	VALUE_BYTES byte = iota
+	VALUE_STRING
+	VALUE_ENCODED
+)
+
+var ErrValueKind = errors.New("unknown value kind")
+
+// encodeValue returns the value prefixed with its kind. Other values are
+// marshaled through a pointer to the interface, so codecs keeping type
+// information (like codec.Gob) decode them back to their concrete type. Types
+// other than the basic ones have to be registered with gob.Register.
+func encodeValue(c codec.Codec, data interface{}) ([]byte, error) {
+	switch v := data.(type) {
+	case []byte:
+		return append([]byte{VALUE_BYTES}, v...), nil
+	case string:
+		return append([]byte{VALUE_STRING}, v...), nil
+	}
+	return c.Marshal([]byte{VALUE_ENCODED}, &data)
+}
+
+// valueBuffers holds buffers for prefixing []byte values with their kind. The
+// caches copy values on Set, so the buffers can be reused right away.
+var valueBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// setBytes calls set with the value prefixed with VALUE_BYTES, without
+// allocating once the pool holds a big enough buffer.
+func setBytes(value []byte, set func([]byte)) {
+	buf := valueBuffers.Get().(*[]byte)
+	*buf = append(append((*buf)[:0], VALUE_BYTES), value...)
+	set(*buf)
+	valueBuffers.Put(buf)
+}
+
+// decodeValue reverses encodeValue. []byte values are returned without
+// copying.
+func decodeValue(c codec.Codec, b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, ErrValueKind
+	}
+	switch b[0] {
+	case VALUE_BYTES:
+		return b[1:], nil
+	case VALUE_STRING:
+		return string(b[1:]), nil
+	case VALUE_ENCODED:
+		var data interface{}
+		if err := c.Unmarshal(b[1:], &data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, ErrValueKind
+}
@@ -0,0 +1,285 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/pkg/store"
+)
+
+type WriteMode int
+
+const (
+	// WRITE_THROUGH writes to the store before the cache, so the store is
+	// always up to date.
+	WRITE_THROUGH WriteMode = iota
+	// WRITE_BACK only writes to the cache and marks the value dirty, dirty
+	// values are written to the store in batches.
+	WRITE_BACK
+)
+
+// LAYERED_BATCH is the default number of evicted dirty values flushed at once.
+const LAYERED_BATCH = 64
+
+type (
+	LayeredConfig struct {
+		Mode WriteMode
+		// FlushInterval is how often all dirty values are flushed in WRITE_BACK
+		// mode, 0 to only flush on eviction and Flush/Close.
+		FlushInterval time.Duration
+		// FlushBatch is the number of evicted dirty values that triggers a
+		// flush of those values.
+		FlushBatch int
+	}
+
+	LayeredDirty struct {
+		data    []byte
+		version uint64
+	}
+
+	// LayeredCache fronts a slower store.Store with a cache. Reads go to the
+	// cache and fall back to the store on a miss, writes go to both (at once
+	// in WRITE_THROUGH mode, or later in WRITE_BACK mode).
+	//
+	// In WRITE_BACK mode dirty values stay tracked until they're flushed, so
+	// values evicted from the cache before reaching the store aren't lost and
+	// can still be read.
+	LayeredCache struct {
+		sync.Mutex
+		cache  RemovalCache
+		store  store.Store
+		config LayeredConfig
+
+		dirty   map[string]*LayeredDirty
+		version uint64
+		// writes changes on every Set and Del, so values loaded from the
+		// store aren't cached over a concurrent write
+		writes uint64
+
+		// keys evicted from the cache, waiting for a batch flush
+		evictedMu sync.Mutex
+		evicted   []string
+
+		// store writes by Set and Del are serialized, outside of the main lock
+		// so Gets don't wait on the store, so the tiers agree on their order
+		storeMu sync.Mutex
+
+		// flushes are serialized so an older value is never written over a
+		// newer one
+		flushMu sync.Mutex
+		stop    chan struct{}
+		stopped sync.Once
+	}
+)
+
+// NewLayeredCache uses the cache (which shouldn't be used directly afterwards)
+// as the hot tier in front of the store. Values are []byte, like the store.
+func NewLayeredCache(cache RemovalCache, s store.Store, config *LayeredConfig) *LayeredCache {
+	c := &LayeredCache{
+		cache:  cache,
+		store:  s,
+		config: *config,
+		dirty:  make(map[string]*LayeredDirty),
+		stop:   make(chan struct{}),
+	}
+	if c.config.FlushBatch <= 0 {
+		c.config.FlushBatch = LAYERED_BATCH
+	}
+
+	if c.config.Mode == WRITE_BACK {
+		cache.OnEvict(c.onEvict)
+		if c.config.FlushInterval > 0 {
+			go c.run()
+		}
+	}
+	return c
+}
+
+// onEvict queues dirty keys leaving the cache to be flushed. Rejected values
+// never made it into the cache, so they're flushed like evicted ones.
+func (c *LayeredCache) onEvict(key string, value interface{}, reason RemovalReason) {
+	if !reason.Evicted() {
+		return
+	}
+
+	c.evictedMu.Lock()
+	c.evicted = append(c.evicted, key)
+	c.evictedMu.Unlock()
+}
+
+func (c *LayeredCache) run() {
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// failed values stay dirty and are retried on the next tick
+			c.Flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Get returns the value from the cache, or from the store on a miss. A nil
+// value (with a nil error) is a miss in both, store.ErrNoValue isn't returned.
+func (c *LayeredCache) Get(key string) (*Value, error) {
+	if value := c.cache.Get(key); value != nil {
+		return value, nil
+	}
+
+	c.Lock()
+	// evicted values that haven't been flushed yet
+	if dirty, exists := c.dirty[key]; exists {
+		c.cache.Set(key, dirty.data)
+		c.Unlock()
+		return &Value{key, dirty.data}, nil
+	}
+	writes := c.writes
+	c.Unlock()
+
+	data, err := c.store.Get(key)
+	if err == store.ErrNoValue {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if c.writes == writes {
+		c.cache.Set(key, data)
+	}
+	c.Unlock()
+	c.flushEvicted()
+	return &Value{key, data}, nil
+}
+
+// Set writes the value to the store and then the cache in WRITE_THROUGH mode
+// (writes are serialized so the two tiers agree), if the store fails the key
+// is dropped from the cache. In WRITE_BACK mode the value is only written to
+// the cache and marked dirty.
+func (c *LayeredCache) Set(key string, data []byte) error {
+	if c.config.Mode == WRITE_BACK {
+		c.Lock()
+		c.writes++
+		c.version++
+		c.dirty[key] = &LayeredDirty{data, c.version}
+		c.cache.Set(key, data)
+		c.Unlock()
+
+		return c.flushEvicted()
+	}
+
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+
+	// Gets loading the old value from the store see writes change once the
+	// new value is cached, so they don't cache the old one over it
+	err := c.store.Set(key, data)
+	c.Lock()
+	c.writes++
+	if err != nil {
+		// the cached value may or may not match the store now
+		c.cache.Del(key)
+	} else {
+		c.cache.Set(key, data)
+	}
+	c.Unlock()
+	return err
+}
+
+// Del removes the key from the store and then the cache (in both modes).
+func (c *LayeredCache) Del(key string) error {
+	// a flush in progress could otherwise write the key back to the store
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+
+	err := c.store.Del(key)
+	c.Lock()
+	c.writes++
+	delete(c.dirty, key)
+	c.cache.Del(key)
+	c.Unlock()
+
+	if err == store.ErrNoValue {
+		return nil
+	}
+	return err
+}
+
+// Dirty returns the number of values not yet written to the store.
+func (c *LayeredCache) Dirty() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.dirty)
+}
+
+// Flush writes all dirty values to the store.
+func (c *LayeredCache) Flush() error {
+	return c.flush(nil)
+}
+
+// flushEvicted flushes the evicted dirty values once there's a batch of them.
+func (c *LayeredCache) flushEvicted() error {
+	c.evictedMu.Lock()
+	if len(c.evicted) < c.config.FlushBatch {
+		c.evictedMu.Unlock()
+		return nil
+	}
+	keys := c.evicted
+	c.evicted = nil
+	c.evictedMu.Unlock()
+
+	return c.flush(keys)
+}
+
+// flush writes the dirty values of keys (or all dirty values if keys is nil)
+// to the store. Values are removed from the dirty set unless they changed
+// while being written. On error the remaining values stay dirty.
+func (c *LayeredCache) flush(keys []string) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	batch := make(map[string]*LayeredDirty)
+	c.Lock()
+	if keys == nil {
+		for key, dirty := range c.dirty {
+			batch[key] = dirty
+		}
+	} else {
+		for _, key := range keys {
+			if dirty, exists := c.dirty[key]; exists {
+				batch[key] = dirty
+			}
+		}
+	}
+	c.Unlock()
+
+	for key, dirty := range batch {
+		if err := c.store.Set(key, dirty.data); err != nil {
+			return err
+		}
+
+		c.Lock()
+		if current, exists := c.dirty[key]; exists && current.version == dirty.version {
+			delete(c.dirty, key)
+		}
+		c.Unlock()
+	}
+	return nil
+}
+
+// Close stops the flush timer and flushes all dirty values.
+func (c *LayeredCache) Close() error {
+	c.stopped.Do(func() { close(c.stop) })
+	return c.Flush()
+}
+
+// Stats returns the stats of the cache tier.
+func (c *LayeredCache) Stats() Stats {
+	return c.cache.Stats()
+}
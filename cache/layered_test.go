@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
+	"github.com/karlmcguire/experiments-cache/pkg/store"
+)
+
+var errStore = errors.New("store failure")
+
+// testStore is a concurrent safe store counting writes, that can be made to
+// fail. If wait is set, writes receive from it when they start and again
+// before they finish.
+type testStore struct {
+	sync.Mutex
+	data   store.Store
+	writes int
+	fail   bool
+	wait   chan struct{}
+}
+
+func newTestStore() *testStore {
+	return &testStore{data: store.NewMapStore(16)}
+}
+
+func (s *testStore) Get(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.data.Get(key)
+}
+
+func (s *testStore) Set(key string, value []byte) error {
+	if s.wait != nil {
+		s.wait <- struct{}{}
+		<-s.wait
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.fail {
+		return errStore
+	}
+	s.writes++
+	return s.data.Set(key, value)
+}
+
+func (s *testStore) Del(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.data.Del(key)
+}
+
+// layeredCaches are the hot tiers the layered tests run against.
+var layeredCaches = map[string]func(size int) RemovalCache{
+	"MapCache":      func(size int) RemovalCache { return NewMapCache(size) },
+	"MapWrapCache":  func(size int) RemovalCache { return NewMapWrapCache(size) },
+	"LockFreeCache": func(size int) RemovalCache { return NewLockFreeCache(size) },
+}
+
+func TestLayeredWriteThrough(t *testing.T) {
+	for name, create := range layeredCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestStore()
+			c := NewLayeredCache(create(4), s, &LayeredConfig{Mode: WRITE_THROUGH})
+
+			if value, err := c.Get("1"); value != nil || err != nil {
+				t.Fatal("missing key should be a miss")
+			}
+			if err := c.Set("1", []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := s.Get("1"); string(data) != "a" {
+				t.Fatal("store not written")
+			}
+			c.Set("1", []byte("b"))
+			if value, _ := c.Get("1"); string(value.Data.([]byte)) != "b" {
+				t.Fatal("stale value cached")
+			}
+			c.Set("1", []byte("a"))
+
+			// values evicted from the cache are read from the store
+			for i := 2; i < 10; i++ {
+				c.Set(fmt.Sprintf("%d", i), []byte("b"))
+			}
+			if value, err := c.Get("1"); err != nil || string(value.Data.([]byte)) != "a" {
+				t.Fatal("store read error")
+			}
+
+			s.fail = true
+			if err := c.Set("1", []byte("c")); err != errStore {
+				t.Fatal("store error not returned")
+			}
+			s.fail = false
+			if value, _ := c.Get("1"); string(value.Data.([]byte)) != "a" {
+				t.Fatal("failed write cached")
+			}
+
+			c.Del("1")
+			if value, err := c.Get("1"); value != nil || err != nil {
+				t.Fatal("del error")
+			}
+		})
+	}
+}
+
+// TestLayeredOverwrite checks that updating a key replaces the cached value
+// rather than removing it first.
+func TestLayeredOverwrite(t *testing.T) {
+	for name, create := range layeredCaches {
+		t.Run(name, func(t *testing.T) {
+			cache := create(4)
+			reasons := make(map[RemovalReason]int)
+			cache.OnEvict(func(key string, value interface{}, reason RemovalReason) {
+				reasons[reason]++
+			})
+			c := NewLayeredCache(cache, newTestStore(), &LayeredConfig{Mode: WRITE_THROUGH})
+
+			c.Set("1", []byte("a"))
+			c.Set("1", []byte("b"))
+			if reasons[removal.EXPLICIT] != 0 || reasons[removal.REPLACED] != 1 {
+				t.Fatalf("overwrite removals: %v", reasons)
+			}
+			if value := cache.Get("1"); value == nil || string(value.Data.([]byte)) != "b" {
+				t.Fatal("value not replaced")
+			}
+		})
+	}
+}
+
+// TestLayeredSlowStore checks that Gets missing the cache don't wait on store
+// writes.
+func TestLayeredSlowStore(t *testing.T) {
+	s := newTestStore()
+	c := NewLayeredCache(NewMapCache(4), s, &LayeredConfig{Mode: WRITE_THROUGH})
+	s.Set("1", []byte("a"))
+
+	s.wait = make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.Set("2", []byte("b")) }()
+	<-s.wait
+
+	got := make(chan *Value)
+	go func() {
+		value, _ := c.Get("1")
+		got <- value
+	}()
+	select {
+	case value := <-got:
+		if value == nil || string(value.Data.([]byte)) != "a" {
+			t.Fatal("get error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("get waited on the store")
+	}
+	s.wait <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayeredWriteBack(t *testing.T) {
+	for name, create := range layeredCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestStore()
+			c := NewLayeredCache(create(4), s, &LayeredConfig{
+				Mode:       WRITE_BACK,
+				FlushBatch: 4,
+			})
+
+			c.Set("1", []byte("a"))
+			c.Set("1", []byte("b"))
+			if s.writes != 0 || c.Dirty() != 1 {
+				t.Fatal("write back wrote to store")
+			}
+
+			// evicted dirty values are still readable before they're flushed
+			for i := 2; i < 6; i++ {
+				c.Set(fmt.Sprintf("%d", i), []byte("c"))
+			}
+			if value, _ := c.Get("1"); string(value.Data.([]byte)) != "b" {
+				t.Fatal("evicted dirty value lost")
+			}
+
+			// enough evictions flush them in a batch
+			for i := 6; i < 16; i++ {
+				c.Set(fmt.Sprintf("%d", i), []byte("c"))
+			}
+			if s.writes == 0 || c.Dirty() == 16-1 {
+				t.Fatal("evicted values not flushed")
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Dirty() != 0 {
+				t.Fatal("close didn't flush")
+			}
+			for i := 1; i < 16; i++ {
+				if _, err := s.Get(fmt.Sprintf("%d", i)); err != nil {
+					t.Fatalf("%d not flushed", i)
+				}
+			}
+			if data, _ := s.Get("1"); string(data) != "b" {
+				t.Fatal("old value flushed")
+			}
+		})
+	}
+}
+
+func TestLayeredFlushError(t *testing.T) {
+	for name, create := range layeredCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestStore()
+			c := NewLayeredCache(create(4), s, &LayeredConfig{Mode: WRITE_BACK})
+
+			c.Set("1", []byte("a"))
+			s.fail = true
+			if err := c.Flush(); err != errStore || c.Dirty() != 1 {
+				t.Fatal("failed flush should keep values dirty")
+			}
+			s.fail = false
+			if err := c.Flush(); err != nil || c.Dirty() != 0 {
+				t.Fatal("retry flush error")
+			}
+		})
+	}
+}
+
+func TestLayeredFlushInterval(t *testing.T) {
+	for name, create := range layeredCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestStore()
+			c := NewLayeredCache(create(4), s, &LayeredConfig{
+				Mode:          WRITE_BACK,
+				FlushInterval: time.Millisecond,
+			})
+			defer c.Close()
+
+			c.Set("1", []byte("a"))
+			for i := 0; i < 100 && c.Dirty() != 0; i++ {
+				time.Sleep(time.Millisecond * 5)
+			}
+			if c.Dirty() != 0 {
+				t.Fatal("timer didn't flush")
+			}
+		})
+	}
+}
+
+func TestLayeredConcurrent(t *testing.T) {
+	for name, create := range layeredCaches {
+		t.Run(name, func(t *testing.T) {
+			s := newTestStore()
+			c := NewLayeredCache(create(16), s, &LayeredConfig{
+				Mode:          WRITE_BACK,
+				FlushInterval: time.Millisecond,
+				FlushBatch:    4,
+			})
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 1000; i++ {
+						key := fmt.Sprintf("%d", (g*i)%64)
+						switch i % 4 {
+						case 0:
+							c.Set(key, []byte(key))
+						case 1:
+							c.Del(key)
+						default:
+							if value, err := c.Get(key); err != nil ||
+								(value != nil && string(value.Data.([]byte)) != key) {
+								t.Error("get error")
+								return
+							}
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			if err := c.Close(); err != nil || c.Dirty() != 0 {
+				t.Fatal("close error")
+			}
+		})
+	}
+}
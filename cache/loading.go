@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// LOADING_SWEEP is the number of negatively cached errors after which expired
+// errors are swept when adding new ones.
+const LOADING_SWEEP = 1024
+
+var ErrLoaderPanic = errors.New("loader panicked")
+
+type (
+	// Loader returns the data for a key that wasn't found in the cache.
+	Loader func(key string) (interface{}, error)
+
+	LoadingCall struct {
+		wg    sync.WaitGroup
+		value *Value
+		err   error
+	}
+
+	LoadingError struct {
+		err        error
+		expiration time.Time
+	}
+
+	// LoadingCache wraps a Cache so that on a miss only one goroutine calls the
+	// loader for a key, while other goroutines asking for the same key wait
+	// for its result. This prevents thundering herds against the backend when
+	// hot keys are evicted.
+	LoadingCache struct {
+		Cache
+
+		mu       sync.Mutex
+		calls    map[string]*LoadingCall
+		errors   map[string]*LoadingError
+		errorTTL time.Duration
+	}
+)
+
+// NewLoadingCache wraps the cache. If errorTTL is greater than zero, loader
+// errors are cached for that long and returned without calling the loader.
+func NewLoadingCache(cache Cache, errorTTL time.Duration) *LoadingCache {
+	return &LoadingCache{
+		Cache:    cache,
+		calls:    make(map[string]*LoadingCall),
+		errors:   make(map[string]*LoadingError),
+		errorTTL: errorTTL,
+	}
+}
+
+// GetOrLoad returns the value for key, calling loader on a miss and adding the
+// loaded data to the cache. Concurrent calls for the same key share a single
+// loader call.
+func (c *LoadingCache) GetOrLoad(key string, loader Loader) (*Value, error) {
+	if value := c.Cache.Get(key); value != nil {
+		return value, nil
+	}
+
+	c.mu.Lock()
+	// check if the key recently failed to load
+	if failed, exists := c.errors[key]; exists {
+		if time.Now().Before(failed.expiration) {
+			c.mu.Unlock()
+			return nil, failed.err
+		}
+		delete(c.errors, key)
+	}
+
+	// wait on the goroutine already loading the key
+	if call, exists := c.calls[key]; exists {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+
+	call := &LoadingCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	c.load(key, call, loader)
+	return call.value, call.err
+}
+
+func (c *LoadingCache) load(key string, call *LoadingCall, loader Loader) {
+	// if loader panics the waiting goroutines still need to be released
+	call.err = ErrLoaderPanic
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		if call.err != nil && c.errorTTL > 0 {
+			c.fail(key, call.err)
+		}
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	// the key may have been loaded between the miss and creating the call
+	if value := c.Cache.Get(key); value != nil {
+		call.value, call.err = value, nil
+		return
+	}
+
+	data, err := loader(key)
+	if err != nil {
+		call.err = err
+		return
+	}
+
+	c.Cache.Set(key, data)
+	call.value, call.err = &Value{key, data}, nil
+}
+
+// fail negatively caches the error. This should only be called while holding
+// the lock.
+func (c *LoadingCache) fail(key string, err error) {
+	now := time.Now()
+
+	// keep keys that will never be requested again from piling up
+	if len(c.errors) >= LOADING_SWEEP {
+		for k, failed := range c.errors {
+			if !now.Before(failed.expiration) {
+				delete(c.errors, k)
+			}
+		}
+	}
+
+	c.errors[key] = &LoadingError{err, now.Add(c.errorTTL)}
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadingCache(t *testing.T) {
+	cache := NewLoadingCache(NewMapCache(CACHE_SIZE), 0)
+
+	var (
+		calls int32
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	loader := func(key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond * 10)
+		return key, nil
+	}
+
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			value, err := cache.GetOrLoad("1", loader)
+			if err != nil || value.Data.(string) != "1" {
+				t.Error("wrong value loaded")
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("loader called %d times", calls)
+	}
+	if cache.Get("1") == nil {
+		t.Fatal("loaded value not cached")
+	}
+}
+
+func TestLoadingCacheError(t *testing.T) {
+	cache := NewLoadingCache(NewMapCache(CACHE_SIZE), time.Millisecond*10)
+
+	calls := 0
+	loadErr := errors.New("backend down")
+	loader := func(key string) (interface{}, error) {
+		calls++
+		return nil, loadErr
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := cache.GetOrLoad("1", loader); err != loadErr {
+			t.Fatal("error not returned")
+		}
+	}
+	if calls != 1 {
+		t.Fatal("error not negatively cached")
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	cache.GetOrLoad("1", loader)
+	if calls != 2 {
+		t.Fatal("negatively cached error didn't expire")
+	}
+}
+
+func TestLoadingCachePanic(t *testing.T) {
+	cache := NewLoadingCache(NewMapCache(CACHE_SIZE), 0)
+
+	func() {
+		defer func() { recover() }()
+		cache.GetOrLoad("1", func(string) (interface{}, error) { panic("oops") })
+	}()
+
+	// the failed call shouldn't block later loads
+	if value, err := cache.GetOrLoad("1", func(key string) (interface{}, error) {
+		return 1, nil
+	}); err != nil || value.Data.(int) != 1 {
+		t.Fatal("load after panic failed")
+	}
+}
@@ -1,7 +1,12 @@
 package cache
 
 import (
+	"fmt"
+	"runtime"
 	"testing"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
 )
 
 func TestCache(t *testing.T) {
@@ -13,6 +18,115 @@ func TestCache(t *testing.T) {
 	c.Set("4", 4)
 }
 
+func TestCacheAdmission(t *testing.T) {
+	c := NewCache(4)
+
+	// make the existing keys hot
+	for i := 0; i < 8; i++ {
+		for k := 1; k <= 4; k++ {
+			c.Set(fmt.Sprintf("%d", k), k)
+		}
+	}
+
+	// a one-hit wonder shouldn't push out a hot key
+	if c.Set("5", 5) {
+		t.Fatal("admitted cold key")
+	}
+	if c.Get("5") != nil {
+		t.Fatal("cold key stored")
+	}
+
+	// but it should get in once it's hotter than the victim
+	for i := 0; i < 16; i++ {
+		c.Set("5", 5)
+	}
+	if c.Get("5") == nil {
+		t.Fatal("hot key rejected")
+	}
+	if c.size != 4 {
+		t.Fatal("capacity error")
+	}
+}
+
+func TestCacheCost(t *testing.T) {
+	c := NewCacheCost(100, 4, func(data interface{}) uint64 {
+		return uint64(len(data.([]byte)))
+	})
+
+	if c.Set("big", make([]byte, 101)) {
+		t.Fatal("admitted entry larger than capacity")
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Set(fmt.Sprintf("%d", i), make([]byte, 25))
+	}
+	if c.Cost() != 100 {
+		t.Fatal("cost error")
+	}
+
+	// replacing a value should only count the new cost
+	c.SetWithCost("0", nil, 10)
+	if c.Cost() != 85 {
+		t.Fatal("replace cost error")
+	}
+
+	// a hot entry should evict as many victims as needed to fit
+	for i := 0; i < 8; i++ {
+		c.SetWithCost("hot", nil, 0)
+	}
+	if !c.Set("hot", make([]byte, 60)) {
+		t.Fatal("hot entry rejected")
+	}
+	if c.Cost() > 100 {
+		t.Fatal("over capacity")
+	}
+}
+
+func TestCacheReplaceRejected(t *testing.T) {
+	c := NewCacheCost(100, 4, func(data interface{}) uint64 {
+		return uint64(len(data.([]byte)))
+	})
+	for i := 0; i < 8; i++ {
+		for k := 0; k < 3; k++ {
+			c.Set(fmt.Sprintf("%d", k), make([]byte, 30))
+		}
+	}
+	c.Set("cold", make([]byte, 10))
+
+	// growing the cold key needs a hot victim, so the new value is rejected
+	// and the old one has to stay
+	if c.Set("cold", make([]byte, 30)) {
+		t.Fatal("admitted cold value over a hot victim")
+	}
+	if value, ok := c.Get("cold").(*Value); !ok || len(value.data.([]byte)) != 10 {
+		t.Fatal("rejected value removed the old one")
+	}
+	if c.Cost() != 100 {
+		t.Fatal("cost error")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := NewCache(4)
+	defer c.Close()
+
+	c.SetWithTTL("1", 1, time.Millisecond)
+	c.SetWithTTL("2", 2, time.Hour)
+	time.Sleep(time.Millisecond * 2)
+
+	if c.Get("1") != nil {
+		t.Fatal("expired value returned")
+	}
+	if c.Get("2") == nil {
+		t.Fatal("unexpired value missing")
+	}
+
+	c.expire([]string{"1", "2"})
+	if c.Cost() != 1 {
+		t.Fatal("expired value not removed")
+	}
+}
+
 func BenchmarkCache(b *testing.B) {
 	c := NewCache(16)
 	c.Set("1", 1)
@@ -25,3 +139,67 @@ func BenchmarkCache(b *testing.B) {
 		}
 	})
 }
+
+func TestCacheStats(t *testing.T) {
+	cache := NewCache(16)
+	for i := 0; i < 64; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	for i := 0; i < 512; i++ {
+		cache.Get(fmt.Sprintf("%d", i%64))
+	}
+
+	stats := cache.Stats()
+	if stats.Sets != 64 || stats.Rejections+stats.TotalEvictions() != 48 {
+		t.Fatal("stats set error")
+	}
+	if stats.CostAdded-stats.CostEvicted != cache.Cost() {
+		t.Fatal("stats cost error")
+	}
+	if stats.Hits != 16*8 || stats.Misses != 48*8 {
+		t.Fatal("stats get error")
+	}
+
+	// enough hits (a quarter of the keys are stored) for one of the buffer's
+	// stripes to fill up
+	for i := 0; i < 4*128*runtime.GOMAXPROCS(0); i++ {
+		cache.Get(fmt.Sprintf("%d", i%64))
+	}
+	if stats := cache.Stats(); stats.Drains == 0 || stats.Dropped != 0 {
+		t.Fatal("stats drain error")
+	}
+}
+
+func TestCacheOnEvict(t *testing.T) {
+	cache := NewCache(4)
+	reasons := make(map[string]removal.Reason)
+	cache.OnEvict(func(key string, value interface{}, reason removal.Reason) {
+		reasons[key] = reason
+		// listeners are called outside the lock
+		cache.Get(key)
+	})
+
+	for i := 0; i < 4; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	cache.Set("0", 0)
+	if reasons["0"] != removal.REPLACED {
+		t.Fatal("replaced error")
+	}
+
+	// a new key is colder than everything in the cache
+	if cache.Set("new", 4) || reasons["new"] != removal.REJECTED {
+		t.Fatal("rejected error")
+	}
+
+	cache.Evict()
+	evicted := 0
+	for _, reason := range reasons {
+		if reason == removal.SIZE {
+			evicted++
+		}
+	}
+	if evicted != 1 {
+		t.Fatal("evicted error")
+	}
+}
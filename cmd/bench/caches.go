@@ -0,0 +1,42 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/karlmcguire/experiments-cache/cache"
+	"github.com/karlmcguire/experiments-cache/sim"
+)
+
+// Target is a cache under benchmark. The simulator's adapters are used, so
+// both commands run the caches the same way.
+type Target = sim.Policy
+
+// ENTRY_SIZE is the number of bytes per entry given to the caches sized in
+// bytes rather than entries.
+const ENTRY_SIZE = 64
+
+// CACHES maps implementation names to constructors taking a capacity in
+// entries: the simulator's policies, along with the unbounded and byte sized
+// caches it leaves out.
+var CACHES = targets()
+
+func targets() map[string]sim.Factory {
+	caches := sim.Policies()
+	// the simulator uses a single shard, which only matters for hit ratios
+	caches["lru-sharded"] = func(capacity int) sim.Policy {
+		return sim.FromCache(cache.NewShardedCache(capacity, runtime.GOMAXPROCS(0)*4))
+	}
+	caches["sync-map"] = func(capacity int) sim.Policy {
+		return sim.FromCache(cache.NewSyncMap(capacity))
+	}
+	caches["sync-map-wrap"] = func(capacity int) sim.Policy {
+		return sim.FromCache(cache.NewSyncMapWrap(capacity))
+	}
+	caches["fastcache"] = func(capacity int) sim.Policy {
+		return sim.FromCache(cache.NewFastCache(capacity * ENTRY_SIZE))
+	}
+	caches["bigcache"] = func(capacity int) sim.Policy {
+		return sim.FromCache(cache.NewBigCache(capacity * ENTRY_SIZE))
+	}
+	return caches
+}
@@ -0,0 +1,231 @@
+// Command bench compares the throughput, latency and hit ratio of the cache
+// implementations under a synthetic workload or a trace file.
+//
+//	bench -caches lru,w-tinylfu,sampled-tinylfu -goroutines 1,4,16 -workload zipf -mix c
+//	bench -trace wiki.gz -format wikipedia -output csv
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/sim/trace"
+	"github.com/karlmcguire/experiments-cache/workload"
+)
+
+var (
+	flagCaches     = flag.String("caches", "", "comma separated caches to run (default all)")
+	flagCapacity   = flag.Int("capacity", 1<<14, "cache capacity in entries")
+	flagGoroutines = flag.String("goroutines", "1,4", "comma separated goroutine counts")
+	flagDuration   = flag.Duration("duration", 2*time.Second, "duration of each run")
+	flagWorkload   = flag.String("workload", "zipf", "key distribution: zipf, scrambled, uniform, hotspot, latest, shifting or scan")
+	flagMix        = flag.String("mix", "c", "YCSB operation mix: a, b, c, d, e or f")
+	flagSkew       = flag.Float64("skew", 0.99, "skew of the zipf based distributions")
+	flagKeys       = flag.Uint64("keys", 1<<20, "size of the key space")
+	flagOps        = flag.Int("ops", 1<<20, "number of operations (or trace keys) to pregenerate")
+	flagTrace      = flag.String("trace", "", "trace file to replay instead of a workload")
+	flagFormat     = flag.String("format", "arc", "trace format: arc, lirs, wikipedia or umass")
+	flagOutput     = flag.String("output", "table", "output format: table, csv or json")
+	flagSeed       = flag.Int64("seed", 1, "random seed")
+)
+
+var MIXES = map[string]workload.Mix{
+	"a": workload.YCSB_A,
+	"b": workload.YCSB_B,
+	"c": workload.YCSB_C,
+	"d": workload.YCSB_D,
+	"e": workload.YCSB_E,
+	"f": workload.YCSB_F,
+}
+
+func main() {
+	flag.Parse()
+	if err := run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(w io.Writer) error {
+	names, err := caches(*flagCaches)
+	if err != nil {
+		return err
+	}
+	goroutines, err := counts(*flagGoroutines)
+	if err != nil {
+		return err
+	}
+	ops, err := operations()
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return errors.New("no operations to run")
+	}
+
+	results := make([]*Result, 0, len(names)*len(goroutines))
+	for _, name := range names {
+		for _, n := range goroutines {
+			result := Run(CACHES[name](*flagCapacity), ops, n, *flagDuration)
+			result.Cache, result.Capacity = name, *flagCapacity
+			results = append(results, result)
+		}
+	}
+
+	switch *flagOutput {
+	case "table":
+		return writeTable(w, results)
+	case "csv":
+		return writeCSV(w, results)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+	return fmt.Errorf("unknown output format: %s", *flagOutput)
+}
+
+func caches(list string) ([]string, error) {
+	if list == "" {
+		names := make([]string, 0, len(CACHES))
+		for name := range CACHES {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		if _, ok := CACHES[name]; !ok {
+			return nil, fmt.Errorf("unknown cache: %s", name)
+		}
+	}
+	return names, nil
+}
+
+func counts(list string) ([]int, error) {
+	fields := strings.Split(list, ",")
+	counts := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid goroutine count: %s", field)
+		}
+		counts[i] = n
+	}
+	return counts, nil
+}
+
+// operations pregenerates the operations to run, so generating them isn't
+// part of the measurement.
+func operations() ([]workload.Operation, error) {
+	if *flagTrace != "" {
+		format, ok := trace.Formats[*flagFormat]
+		if !ok {
+			return nil, fmt.Errorf("unknown trace format: %s", *flagFormat)
+		}
+		keys, closer, err := trace.Open(*flagTrace, format)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		list, err := trace.Keys(keys, *flagOps)
+		if err != nil {
+			return nil, err
+		}
+		ops := make([]workload.Operation, len(list))
+		for i, key := range list {
+			ops[i] = workload.Operation{Op: workload.READ, Key: key, Length: 1}
+		}
+		return ops, nil
+	}
+
+	mix, ok := MIXES[*flagMix]
+	if !ok {
+		return nil, fmt.Errorf("unknown mix: %s", *flagMix)
+	}
+	var (
+		seed, skew, n = *flagSeed, *flagSkew, *flagKeys
+		keys          workload.Generator
+	)
+	if n == 0 {
+		return nil, fmt.Errorf("invalid key count: %d", n)
+	}
+	switch *flagWorkload {
+	case "zipf":
+		keys = workload.NewZipf(seed, skew, n)
+	case "scrambled":
+		keys = workload.NewScrambledZipf(seed, skew, n)
+	case "uniform":
+		keys = workload.NewUniform(seed, n)
+	case "hotspot":
+		keys = workload.NewHotspot(seed, n, 0.2, 0.8)
+	case "latest":
+		keys = workload.NewLatest(seed, skew, n)
+	case "shifting":
+		keys = workload.NewShifting(seed, skew, n, uint64(*flagOps/100+1))
+	case "scan":
+		// the hot keys are the first tenth of the key space
+		if n < 10 {
+			return nil, fmt.Errorf("invalid key count for scan, need at least 10: %d", n)
+		}
+		keys = workload.NewScan(seed, workload.NewZipf(seed, skew, n/10),
+			n/10, n, 1000, 0.001)
+	default:
+		return nil, fmt.Errorf("unknown workload: %s", *flagWorkload)
+	}
+	gen := workload.NewWorkload(seed, mix, keys, n)
+	ops := make([]workload.Operation, *flagOps)
+	for i := range ops {
+		ops[i] = gen.Next()
+	}
+	return ops, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+var HEADER = []string{"cache", "capacity", "goroutines", "ops/sec",
+	"hit ratio", "p50", "p99", "p999", "max"}
+
+func row(r *Result) []string {
+	return []string{
+		r.Cache,
+		strconv.Itoa(r.Capacity),
+		strconv.Itoa(r.Goroutines),
+		strconv.FormatFloat(r.OpsPerSec, 'f', 0, 64),
+		strconv.FormatFloat(r.HitRatio*100, 'f', 2, 64) + "%",
+		r.P50.String(),
+		r.P99.String(),
+		r.P999.String(),
+		r.Max.String(),
+	}
+}
+
+func writeTable(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, strings.Join(HEADER, "\t")+"\t")
+	for _, result := range results {
+		fmt.Fprintln(tw, strings.Join(row(result), "\t")+"\t")
+	}
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, results []*Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write(HEADER)
+	for _, result := range results {
+		cw.Write(row(result))
+	}
+	cw.Flush()
+	return cw.Error()
+}
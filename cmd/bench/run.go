@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/pkg/hdr"
+	"github.com/karlmcguire/experiments-cache/workload"
+)
+
+// LATENCY_SAMPLE is how often (in operations) latency is measured, timing
+// every operation would dominate the cost of the faster caches.
+const LATENCY_SAMPLE = 16
+
+type Result struct {
+	Cache      string        `json:"cache"`
+	Capacity   int           `json:"capacity"`
+	Goroutines int           `json:"goroutines"`
+	Duration   time.Duration `json:"duration"`
+	Ops        uint64        `json:"ops"`
+	OpsPerSec  float64       `json:"ops_per_sec"`
+	Reads      uint64        `json:"reads"`
+	Hits       uint64        `json:"hits"`
+	HitRatio   float64       `json:"hit_ratio"`
+	P50        time.Duration `json:"p50"`
+	P99        time.Duration `json:"p99"`
+	P999       time.Duration `json:"p999"`
+	Max        time.Duration `json:"max"`
+}
+
+type worker struct {
+	ops       uint64
+	reads     uint64
+	hits      uint64
+	latencies *hdr.Histogram
+}
+
+// get reads the key, filling the cache on a miss.
+func (w *worker) get(target Target, key string) {
+	w.reads++
+	if target.Get(key) {
+		w.hits++
+		return
+	}
+	target.Set(key)
+}
+
+func (w *worker) do(target Target, op workload.Operation) {
+	switch op.Op {
+	case workload.READ:
+		w.get(target, op.Key)
+	case workload.UPDATE, workload.INSERT:
+		target.Set(op.Key)
+	case workload.READ_MODIFY_WRITE:
+		w.get(target, op.Key)
+		target.Set(op.Key)
+	case workload.DELETE:
+		target.Del(op.Key)
+	case workload.SCAN:
+		start, err := strconv.ParseUint(op.Key, 10, 64)
+		if err != nil {
+			w.get(target, op.Key)
+			break
+		}
+		for i := 0; i < op.Length; i++ {
+			w.get(target, workload.Key(start+uint64(i)))
+		}
+	}
+}
+
+// Run runs the operations against the target from the given number of
+// goroutines for duration. Each goroutine starts at a random offset in ops
+// and wraps around.
+func Run(target Target, ops []workload.Operation, goroutines int,
+	duration time.Duration) *Result {
+	var (
+		done    int32
+		wg      sync.WaitGroup
+		workers = make([]*worker, goroutines)
+	)
+	for i := range workers {
+		workers[i] = &worker{latencies: hdr.New()}
+	}
+
+	start := time.Now()
+	for i := range workers {
+		wg.Add(1)
+		go func(w *worker, offset int) {
+			defer wg.Done()
+			for n := offset; atomic.LoadInt32(&done) == 0; n++ {
+				op := ops[n%len(ops)]
+				if w.ops%LATENCY_SAMPLE == 0 {
+					before := time.Now()
+					w.do(target, op)
+					w.latencies.Record(time.Since(before))
+				} else {
+					w.do(target, op)
+				}
+				w.ops++
+			}
+		}(workers[i], rand.Intn(len(ops)))
+	}
+	time.Sleep(duration)
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	result := &Result{Goroutines: goroutines, Duration: elapsed}
+	latencies := hdr.New()
+	for _, w := range workers {
+		result.Ops += w.ops
+		result.Reads += w.reads
+		result.Hits += w.hits
+		latencies.Merge(w.latencies)
+	}
+	result.OpsPerSec = float64(result.Ops) / elapsed.Seconds()
+	if result.Reads > 0 {
+		result.HitRatio = float64(result.Hits) / float64(result.Reads)
+	}
+	result.P50 = latencies.Percentile(0.5)
+	result.P99 = latencies.Percentile(0.99)
+	result.P999 = latencies.Percentile(0.999)
+	result.Max = latencies.Max()
+	return result
+}
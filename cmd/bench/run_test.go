@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/workload"
+)
+
+func TestRun(t *testing.T) {
+	gen := workload.NewWorkload(1, workload.YCSB_A, workload.NewZipf(1, 0.99, 1000), 1000)
+	ops := make([]workload.Operation, 10000)
+	for i := range ops {
+		ops[i] = gen.Next()
+	}
+	for name, create := range CACHES {
+		result := Run(create(100), ops, 2, 10*time.Millisecond)
+		if result.Ops == 0 || result.Reads == 0 || result.Hits > result.Reads {
+			t.Fatalf("%s: bad result %+v", name, result)
+		}
+		if result.P50 > result.P99 || result.P99 > result.Max {
+			t.Fatalf("%s: bad percentiles", name)
+		}
+	}
+}
+
+func TestOperationsKeys(t *testing.T) {
+	defer func(workload string, keys uint64) {
+		*flagWorkload, *flagKeys = workload, keys
+	}(*flagWorkload, *flagKeys)
+
+	*flagWorkload, *flagKeys = "scan", 5
+	if _, err := operations(); err == nil {
+		t.Fatal("expected scan to reject fewer than 10 keys")
+	}
+	*flagWorkload, *flagKeys = "zipf", 0
+	if _, err := operations(); err == nil {
+		t.Fatal("expected an empty key space to be rejected")
+	}
+}
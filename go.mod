@@ -1,11 +1,16 @@
 module github.com/karlmcguire/experiments-cache
 
-go 1.12
+go 1.18
 
 require (
 	github.com/VictoriaMetrics/fastcache v1.5.0
 	github.com/allegro/bigcache v1.2.1-0.20190218064605-e24eb225f156
 	github.com/davecgh/go-spew v1.1.1
+	github.com/golang/snappy v0.0.1
 	github.com/minio/highwayhash v1.0.0
-	github.com/xba/stress v0.0.0-20190422191359-cf82eac25c59
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.0.1-0.20190104013014-3767db7a7e18 // indirect
+	golang.org/x/sys v0.0.0-20190130150945-aca44879d564 // indirect
 )
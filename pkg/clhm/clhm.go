@@ -1,7 +1,10 @@
 package clhm
 
 import (
+	"bytes"
 	"container/list"
+	"sync"
+	"sync/atomic"
 
 	"github.com/karlmcguire/experiments-cache/pkg/try"
 	"github.com/karlmcguire/experiments-cache/pkg/util"
@@ -13,36 +16,98 @@ const (
 	DEL
 )
 
+// HASH_MASK keeps the lower 62 bits of key hashes, leaving room for the access
+// type in recorded blocks.
+const HASH_MASK = 1<<62 - 1
+
 type (
 	Config struct {
 		BufferCount     uint32
 		BufferSize      uint32
 		BufferThreshold uint32
 		MapSize         uint32
+		// MaxCost bounds the total cost of the entries, MapSize is used if 0.
+		MaxCost uint64
+		// Cost returns the cost of a value passed to Set, every value costs 1
+		// if nil.
+		Cost func(interface{}) uint64
+		// Hash is used for hashing keys, util.Hash64 is used if nil.
+		Hash func([]byte) uint64
 	}
 
+	// Buffer is a lossy read buffer. Blocks are added without locking and are
+	// dropped if the buffer is full, which is fine because they only affect
+	// the LRU order.
 	Buffer struct {
 		config *Config
 		id     int
-		reads  int
-		writes int
+		writes uint32
 		blocks []uint64
 	}
 
+	// task is a pending write (SET or DEL) to be applied to the LRU list.
+	task struct {
+		kind  uint64
+		entry *entry
+		cost  uint64
+	}
+
+	// entry is a key-value pair. Entries with the same hash are chained and
+	// told apart by comparing the full key.
+	entry struct {
+		hash    uint64
+		key     []byte
+		value   interface{}
+		next    *entry
+		elem    *list.Element
+		removed bool
+		// cost is only accessed while draining
+		cost uint64
+	}
+
+	// Map is a concurrent linked hash map in the style of Ben Manes'
+	// ConcurrentLinkedHashMap. The hash map is protected by its own lock while
+	// the LRU list is only modified when draining the buffers, so reads never
+	// wait on the LRU lock.
+	//
+	// This implements the BP-Wrapper batching described in the README: reads
+	// are recorded in lossy buffers and drained under TryLock once a buffer
+	// reaches BufferThreshold, writes are recorded in a write buffer that is
+	// always drained.
 	Map struct {
 		try.Mutex
 
 		config   *Config
-		elem     map[uint32]*list.Element
+		elemMu   sync.RWMutex
+		elem     map[uint64]*entry
+		count    int
 		data     *list.List
+		used     uint64
 		buffers  []*Buffer
 		buffMask uint32
+		writeMu  sync.Mutex
+		writes   []task
 	}
 )
 
 func New(config *Config) *Map {
+	if config.BufferThreshold == 0 || config.BufferThreshold > config.BufferSize {
+		config.BufferThreshold = config.BufferSize
+	}
+
+	if config.Hash == nil {
+		config.Hash = util.Hash64
+	}
+	if config.MaxCost == 0 {
+		config.MaxCost = uint64(config.MapSize)
+	}
+	if config.Cost == nil {
+		config.Cost = func(interface{}) uint64 { return 1 }
+	}
+
 	m := &Map{
-		elem:     make(map[uint32]*list.Element, config.MapSize),
+		config:   config,
+		elem:     make(map[uint64]*entry, config.MapSize),
 		data:     list.New(),
 		buffers:  make([]*Buffer, config.BufferCount),
 		buffMask: config.BufferCount - 1,
@@ -60,43 +125,279 @@ func New(config *Config) *Map {
 	return m
 }
 
-func (m *Map) Record(kind uint64, key []byte, hash uint32) {
+func (m *Map) Record(kind uint64, key []byte, hash uint64) {
 	// set the MSB to the corresponding access type
 	//
 	// 00 -> GET
 	// 01 -> SET
 	// 10 -> DEL
 	//
-	// this leaves the 32 LSB being the hashed key for later lookup
-	block := uint64(hash) | (kind << 62)
+	// this leaves the 62 LSB being the hashed key for later lookup
+	block := hash&HASH_MASK | (kind << 62)
+
+	// record the access in the buffer and attempt to drain if it's past the
+	// threshold
+	if m.buffers[uint32(hash)&m.buffMask].Add(block) {
+		m.drain(false)
+	}
+}
+
+func (m *Map) hash(key []byte) uint64 {
+	return m.config.Hash(key) & HASH_MASK
+}
+
+// lookup returns the entry for key in the hash chain. This should only be
+// called while holding elemMu.
+func (m *Map) lookup(hash uint64, key []byte) *entry {
+	for e := m.elem[hash]; e != nil; e = e.next {
+		if bytes.Equal(e.key, key) {
+			return e
+		}
+	}
+	return nil
+}
+
+// insert adds the entry to the front of its hash chain. This should only be
+// called while holding elemMu.
+func (m *Map) insert(e *entry) {
+	e.next = m.elem[e.hash]
+	m.elem[e.hash] = e
+	m.count++
+}
 
-	// record the access in the buffer
-	m.buffers[hash&m.buffMask].Add(block)
+// unlink removes the entry from its hash chain. This should only be called
+// while holding elemMu.
+func (m *Map) unlink(e *entry) {
+	for next := m.elem[e.hash]; next != nil; next = next.next {
+		if next == e {
+			m.elem[e.hash] = e.next
+			break
+		}
+		if next.next == e {
+			next.next = e.next
+			break
+		}
+	}
+	if m.elem[e.hash] == nil {
+		delete(m.elem, e.hash)
+	}
+	m.count--
 }
 
 func (m *Map) Get(key []byte) interface{} {
-	hash := util.Hash32(key)
+	hash := m.hash(key)
 
-	if elem, exists := m.elem[hash]; !exists {
+	m.elemMu.RLock()
+	e := m.lookup(hash, key)
+	if e == nil {
+		m.elemMu.RUnlock()
 		return nil
-	} else {
-		// record the access to the buffers
-		defer m.Record(GET, key, hash)
-		return elem.Value
 	}
+	value := e.value
+	m.elemMu.RUnlock()
+
+	// record the access to the buffers
+	m.Record(GET, key, hash)
+	return value
 }
 
+// GetBytes appends the value to dst, returning false on a miss or if the value
+// isn't a []byte. It doesn't allocate.
+func (m *Map) GetBytes(dst, key []byte) ([]byte, bool) {
+	value, ok := m.Get(key).([]byte)
+	if !ok {
+		return dst, false
+	}
+	return append(dst, value...), true
+}
+
+// SetBytes stores a copy of the value, so the caller can reuse it.
+func (m *Map) SetBytes(key, value []byte) {
+	m.Set(key, append([]byte{}, value...))
+}
+
+func (m *Map) DelBytes(key []byte) {
+	m.Del(key)
+}
+
+// Set adds the key-value pair to the map. If an element was evicted while
+// draining, its key and value are returned.
 func (m *Map) Set(key []byte, value interface{}) ([]byte, interface{}) {
-	m.elem[util.Hash32(key)] = m.data.PushFront(value)
-	return nil, nil
+	victimKey, victimValue, _ := m.SetWithCost(key, value, m.config.Cost(value))
+	return victimKey, victimValue
+}
+
+// SetWithCost is like Set but uses the provided cost instead of calling
+// Config.Cost. Values costing more than MaxCost are rejected, returning false.
+func (m *Map) SetWithCost(key []byte, value interface{}, cost uint64) ([]byte, interface{}, bool) {
+	if cost > m.config.MaxCost {
+		return nil, nil, false
+	}
+	hash := m.hash(key)
+
+	m.elemMu.Lock()
+	e := m.lookup(hash, key)
+	if e != nil {
+		e.value = value
+	} else {
+		// copy the key in case the caller reuses it
+		e = &entry{hash: hash, key: append([]byte{}, key...), value: value}
+		m.insert(e)
+	}
+	m.elemMu.Unlock()
+
+	m.write(task{SET, e, cost})
+	victimKey, victimValue := m.drain(true)
+	return victimKey, victimValue, true
 }
 
+// Del removes the key from the map and returns the value, if any.
 func (m *Map) Del(key []byte) interface{} {
-	return nil
+	hash := m.hash(key)
+
+	m.elemMu.Lock()
+	e := m.lookup(hash, key)
+	if e == nil {
+		m.elemMu.Unlock()
+		return nil
+	}
+	m.unlink(e)
+	value := e.value
+	m.elemMu.Unlock()
+
+	m.write(task{DEL, e, 0})
+	m.drain(true)
+	return value
+}
+
+// Cost returns the total cost of the elements in the LRU list, which lags
+// behind Len until the buffered writes are drained.
+func (m *Map) Cost() uint64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.used
+}
+
+// Len returns the number of elements in the map.
+func (m *Map) Len() int {
+	m.elemMu.RLock()
+	defer m.elemMu.RUnlock()
+	return m.count
+}
+
+func (m *Map) write(t task) {
+	m.writeMu.Lock()
+	m.writes = append(m.writes, t)
+	m.writeMu.Unlock()
+}
+
+// drain applies the buffered writes and reads to the LRU list and evicts until
+// the map fits within MaxCost. If required is false, draining is skipped when
+// another goroutine is already draining. The last victim is returned.
+func (m *Map) drain(required bool) (victimKey []byte, victimValue interface{}) {
+	if required {
+		m.Lock()
+	} else if !m.TryLock() {
+		return
+	}
+	defer m.Unlock()
+
+	// writes are always applied first so reads can find new elements
+	m.writeMu.Lock()
+	writes := m.writes
+	m.writes = nil
+	m.writeMu.Unlock()
+
+	for _, t := range writes {
+		switch t.kind {
+		case SET:
+			if t.entry.removed {
+				continue
+			}
+			if t.entry.elem != nil {
+				m.used += t.cost - t.entry.cost
+				t.entry.cost = t.cost
+				m.data.MoveToFront(t.entry.elem)
+				continue
+			}
+			// the entry may have been evicted between being set and this
+			// drain, in which case it's added back unless the key was set
+			// again since
+			m.elemMu.Lock()
+			current := m.lookup(t.entry.hash, t.entry.key)
+			if current == nil {
+				m.insert(t.entry)
+			}
+			m.elemMu.Unlock()
+			if current == nil || current == t.entry {
+				t.entry.elem = m.data.PushFront(t.entry)
+				t.entry.cost = t.cost
+				m.used += t.cost
+			}
+		case DEL:
+			t.entry.removed = true
+			if t.entry.elem != nil {
+				m.data.Remove(t.entry.elem)
+				t.entry.elem = nil
+				m.used -= t.entry.cost
+			}
+		}
+	}
+
+	// apply reads in batches, blocks only hold the hash so every entry in the
+	// chain is moved (collisions only affect LRU order, never values)
+	m.elemMu.RLock()
+	for _, buffer := range m.buffers {
+		buffer.Drain(func(block uint64) {
+			for e := m.elem[block&HASH_MASK]; e != nil; e = e.next {
+				if e.elem != nil {
+					m.data.MoveToFront(e.elem)
+				}
+			}
+		})
+	}
+	m.elemMu.RUnlock()
+
+	// enforce capacity
+	for m.used > m.config.MaxCost {
+		victim := m.data.Remove(m.data.Back()).(*entry)
+		victim.elem = nil
+		m.used -= victim.cost
+
+		m.elemMu.Lock()
+		if m.lookup(victim.hash, victim.key) == victim {
+			m.unlink(victim)
+		}
+		victimKey, victimValue = victim.key, victim.value
+		m.elemMu.Unlock()
+	}
+
+	return
+}
+
+// Add records the block in the buffer and returns true if the buffer is past
+// the threshold and should be drained. Blocks added while the buffer is full
+// are dropped.
+func (b *Buffer) Add(block uint64) bool {
+	i := atomic.AddUint32(&b.writes, 1) - 1
+	if i < b.config.BufferSize {
+		atomic.StoreUint64(&b.blocks[i], block)
+	}
+	return i+1 >= b.config.BufferThreshold
 }
 
-func (b *Buffer) Add(block uint64) {
-	// TODO
-	// add to the buffer
-	// check if drain is needed
+// Drain calls apply on each block in the buffer and resets it. This should
+// only be called while holding the Map lock.
+func (b *Buffer) Drain(apply func(uint64)) {
+	n := atomic.SwapUint32(&b.writes, 0)
+	if n > b.config.BufferSize {
+		n = b.config.BufferSize
+	}
+
+	for i := uint32(0); i < n; i++ {
+		// a zero block hasn't been stored yet by a racing Add, so it's dropped
+		if block := atomic.SwapUint64(&b.blocks[i], 0); block != 0 {
+			apply(block)
+		}
+	}
 }
@@ -2,6 +2,7 @@ package clhm
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -16,5 +17,194 @@ func TestCLHM(t *testing.T) {
 		m.Set([]byte(fmt.Sprintf("%d", i)), i)
 	}
 
-	fmt.Println(m.Get([]byte("1")))
+	if m.Get([]byte("1")).(int) != 1 {
+		t.Fatal("set/get error")
+	}
+
+	if m.Del([]byte("1")).(int) != 1 || m.Get([]byte("1")) != nil {
+		t.Fatal("del error")
+	}
+}
+
+func TestCLHMEvict(t *testing.T) {
+	m := New(&Config{
+		BufferCount:     4,
+		BufferSize:      4,
+		BufferThreshold: 1,
+		MapSize:         16,
+	})
+
+	for i := 0; i < 16; i++ {
+		m.Set([]byte(fmt.Sprintf("%d", i)), i)
+	}
+
+	// reads are drained on every access with a threshold of 1, so "0" is now
+	// the most recently used element
+	m.Get([]byte("0"))
+
+	key, value := m.Set([]byte("16"), 16)
+	if string(key) != "1" || value.(int) != 1 {
+		t.Fatalf("evicted wrong element: %s", key)
+	}
+	if m.Len() != 16 || m.Get([]byte("0")) == nil {
+		t.Fatal("capacity error")
+	}
+}
+
+func TestCLHMCost(t *testing.T) {
+	m := New(&Config{
+		BufferCount: 4,
+		BufferSize:  4,
+		MapSize:     16,
+		MaxCost:     100,
+		Cost: func(value interface{}) uint64 {
+			return uint64(len(value.([]byte)))
+		},
+	})
+
+	if _, _, ok := m.SetWithCost([]byte("big"), nil, 101); ok || m.Len() != 0 {
+		t.Fatal("admitted element larger than the map")
+	}
+	for i := 0; i < 4; i++ {
+		m.Set([]byte(fmt.Sprintf("%d", i)), make([]byte, 25))
+	}
+	if m.Len() != 4 || m.Cost() != 100 {
+		t.Fatal("cost error")
+	}
+
+	// replacing a value only counts the new cost
+	m.Set([]byte("0"), make([]byte, 10))
+	if m.Cost() != 85 {
+		t.Fatal("replace cost error")
+	}
+
+	// a large element evicts as many elements as needed to fit
+	key, _ := m.Set([]byte("large"), make([]byte, 60))
+	if key == nil || m.Cost() > 100 || m.Get([]byte("large")) == nil {
+		t.Fatal("eviction error")
+	}
+	m.Del([]byte("large"))
+	if m.Cost() > 40 {
+		t.Fatal("del cost error")
+	}
+}
+
+func TestCLHMCollision(t *testing.T) {
+	m := New(&Config{
+		BufferCount:     4,
+		BufferSize:      4,
+		BufferThreshold: 1,
+		MapSize:         4,
+		// every key collides
+		Hash: func([]byte) uint64 { return 1 },
+	})
+
+	for i := 0; i < 4; i++ {
+		m.Set([]byte(fmt.Sprintf("%d", i)), i)
+	}
+	for i := 0; i < 4; i++ {
+		if m.Get([]byte(fmt.Sprintf("%d", i))).(int) != i {
+			t.Fatal("collision overwrote value")
+		}
+	}
+
+	m.Del([]byte("2"))
+	if m.Get([]byte("2")) != nil || m.Get([]byte("3")).(int) != 3 {
+		t.Fatal("collision del error")
+	}
+
+	m.Set([]byte("4"), 4)
+	key, _ := m.Set([]byte("5"), 5)
+	if key == nil || m.Len() != 4 || m.Get(key) != nil {
+		t.Fatal("collision eviction error")
+	}
+}
+
+func TestCLHMConcurrent(t *testing.T) {
+	m := New(&Config{
+		BufferCount:     4,
+		BufferSize:      16,
+		BufferThreshold: 12,
+		MapSize:         64,
+	})
+
+	// every goroutine cycles through 4x as many keys as the map holds
+	const n, keys = 10000, 256
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("%d", (g*n+i)%keys))
+				switch i % 4 {
+				case 0:
+					m.Set(key, i)
+				case 1:
+					m.Del(key)
+				default:
+					m.Get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if m.Len() > 64 {
+		t.Fatal("capacity error")
+	}
+}
+
+func TestCLHMBytes(t *testing.T) {
+	m := New(&Config{
+		BufferCount: 4,
+		BufferSize:  4,
+		MapSize:     16,
+	})
+
+	key, value := []byte("key"), []byte("value")
+	m.SetBytes(key, value)
+	// the map has its own copy
+	value[0] = 'V'
+	if dst, ok := m.GetBytes([]byte("prefix "), key); !ok || string(dst) != "prefix value" {
+		t.Fatalf("get error: %q", dst)
+	}
+	m.Set([]byte("int"), 1)
+	if _, ok := m.GetBytes(nil, []byte("int")); ok {
+		t.Fatal("non []byte value error")
+	}
+
+	dst := make([]byte, 0, 64)
+	if n := testing.AllocsPerRun(100, func() { m.GetBytes(dst[:0], key) }); n != 0 {
+		t.Fatalf("expected no allocations on a hit, got %v", n)
+	}
+
+	m.DelBytes(key)
+	if _, ok := m.GetBytes(nil, key); ok {
+		t.Fatal("del error")
+	}
+}
+
+func BenchmarkCLHM(b *testing.B) {
+	m := New(&Config{
+		BufferCount:     16,
+		BufferSize:      64,
+		BufferThreshold: 48,
+		MapSize:         256,
+	})
+	m.Set([]byte("1"), 1)
+	key := []byte("1")
+	if n := testing.AllocsPerRun(100, func() { m.Get(key) }); n != 0 {
+		b.Fatalf("expected no allocations on a hit, got %v", n)
+	}
+
+	b.SetBytes(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		key := []byte("1")
+		for pb.Next() {
+			m.Get(key)
+		}
+	})
 }
@@ -0,0 +1,332 @@
+package codec
+
+import (
+	"encoding"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sync"
+)
+
+var (
+	marshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+	// marshalers caches usesMarshaler, Implements is slow
+	marshalers sync.Map
+)
+
+// Binary is a compact format without type information, so values have to be
+// decoded into the type they were encoded from. Integers are varints, floats
+// are fixed size, strings, slices and maps are prefixed with their length and
+// structs are their exported fields in order. Pointers, slices and maps are
+// prefixed so nil survives a round trip. Types implementing both
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler (like time.Time) are
+// encoded with them. Interfaces, channels, funcs and complex numbers aren't
+// supported.
+type Binary struct{}
+
+func (Binary) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	start := len(dst)
+	dst, err := appendValue(dst, reflect.ValueOf(v))
+	if err != nil {
+		return dst[:start], err
+	}
+	return dst, nil
+}
+
+func (Binary) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrType
+	}
+	d := &decoder{data: data}
+	if err := d.value(rv.Elem()); err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return ErrTruncated
+	}
+	return nil
+}
+
+// usesMarshaler returns true for types encoded with their MarshalBinary and
+// decoded with their UnmarshalBinary. Pointers are always encoded as a nil
+// flag followed by the value.
+func usesMarshaler(t reflect.Type) bool {
+	if uses, ok := marshalers.Load(t); ok {
+		return uses.(bool)
+	}
+	pointer := reflect.PtrTo(t)
+	uses := t.Kind() != reflect.Ptr &&
+		pointer.Implements(marshalerType) && pointer.Implements(unmarshalerType)
+	marshalers.Store(t, uses)
+	return uses
+}
+
+func appendUvarint(dst []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+// appendLen appends n+1, or 0 for nil.
+func appendLen(dst []byte, rv reflect.Value) []byte {
+	if rv.IsNil() {
+		return append(dst, 0)
+	}
+	return appendUvarint(dst, uint64(rv.Len())+1)
+}
+
+func appendValue(dst []byte, rv reflect.Value) ([]byte, error) {
+	if !rv.IsValid() {
+		return dst, ErrType
+	}
+	if usesMarshaler(rv.Type()) {
+		// the methods may have pointer receivers
+		if !rv.CanAddr() {
+			addressable := reflect.New(rv.Type()).Elem()
+			addressable.Set(rv)
+			rv = addressable
+		}
+		b, err := rv.Addr().Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return dst, err
+		}
+		return append(appendUvarint(dst, uint64(len(b))), b...), nil
+	}
+
+	var err error
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return append(dst, 1), nil
+		}
+		return append(dst, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var buf [binary.MaxVarintLen64]byte
+		return append(dst, buf[:binary.PutVarint(buf[:], rv.Int())]...), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return appendUvarint(dst, rv.Uint()), nil
+	case reflect.Float32:
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(rv.Float())))
+		return append(dst, buf[:]...), nil
+	case reflect.Float64:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(rv.Float()))
+		return append(dst, buf[:]...), nil
+	case reflect.String:
+		s := rv.String()
+		return append(appendUvarint(dst, uint64(len(s))), s...), nil
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return append(dst, 0), nil
+		}
+		return appendValue(append(dst, 1), rv.Elem())
+	case reflect.Slice:
+		dst = appendLen(dst, rv)
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return append(dst, rv.Bytes()...), nil
+		}
+		for i := 0; i < rv.Len() && err == nil; i++ {
+			dst, err = appendValue(dst, rv.Index(i))
+		}
+		return dst, err
+	case reflect.Array:
+		for i := 0; i < rv.Len() && err == nil; i++ {
+			dst, err = appendValue(dst, rv.Index(i))
+		}
+		return dst, err
+	case reflect.Map:
+		dst = appendLen(dst, rv)
+		iter := rv.MapRange()
+		for err == nil && iter.Next() {
+			if dst, err = appendValue(dst, iter.Key()); err == nil {
+				dst, err = appendValue(dst, iter.Value())
+			}
+		}
+		return dst, err
+	case reflect.Struct:
+		t := rv.Type()
+		for i := 0; i < rv.NumField() && err == nil; i++ {
+			if t.Field(i).IsExported() {
+				dst, err = appendValue(dst, rv.Field(i))
+			}
+		}
+		return dst, err
+	}
+	return dst, ErrType
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) next(n uint64) ([]byte, error) {
+	if uint64(len(d.data)) < n {
+		return nil, ErrTruncated
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, ErrTruncated
+	}
+	d.data = d.data[n:]
+	return x, nil
+}
+
+// bytes returns the next length prefixed bytes.
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	return d.next(n)
+}
+
+// length reads a prefix written by appendLen, returning -1 for nil.
+func (d *decoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	// every element takes at least a byte, which bounds allocations on
+	// corrupt input
+	if n > uint64(len(d.data))+1 {
+		return 0, ErrTruncated
+	}
+	return int(n) - 1, nil
+}
+
+func (d *decoder) value(rv reflect.Value) error {
+	// decoded values are always addressable
+	if usesMarshaler(rv.Type()) {
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		return rv.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		rv.SetBool(b[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(d.data)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		d.data = d.data[n:]
+		rv.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		rv.SetUint(x)
+	case reflect.Float32:
+		b, err := d.next(4)
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case reflect.Float64:
+		b, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case reflect.String:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		rv.SetString(string(b))
+	case reflect.Ptr:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.value(rv.Elem())
+	case reflect.Slice:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.next(uint64(n))
+			if err != nil {
+				return err
+			}
+			rv.SetBytes(append(make([]byte, 0, n), b...))
+			return nil
+		}
+		rv.Set(reflect.MakeSlice(rv.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := d.value(rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := d.value(rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		t := rv.Type()
+		rv.Set(reflect.MakeMapWithSize(t, n))
+		for i := 0; i < n; i++ {
+			key, value := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+			if err := d.value(key); err != nil {
+				return err
+			}
+			if err := d.value(value); err != nil {
+				return err
+			}
+			rv.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		t := rv.Type()
+		for i := 0; i < rv.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				if err := d.value(rv.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return ErrType
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	"github.com/golang/snappy"
+	"github.com/karlmcguire/experiments-cache/pkg/store"
+)
+
+var (
+	ErrType      = errors.New("type not supported by codec")
+	ErrFormat    = errors.New("unknown compression format")
+	ErrTruncated = errors.New("data truncated")
+)
+
+// Codec converts values to and from bytes, for keeping Go values in caches
+// and stores that only hold []byte.
+type Codec interface {
+	// Marshal appends the encoding of v to dst.
+	Marshal(dst []byte, v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, which must be a pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Bytes stores []byte and string values as they are.
+type Bytes struct{}
+
+func (Bytes) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return append(dst, v...), nil
+	case string:
+		return append(dst, v...), nil
+	}
+	return dst, ErrType
+}
+
+// Unmarshal copies data into a *[]byte (reusing its capacity) or *string.
+func (Bytes) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	}
+	return ErrType
+}
+
+// Gob encodes values with encoding/gob. Each value carries its type
+// information, so it's the most flexible but the largest and slowest format.
+type Gob struct{}
+
+func (Gob) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (Gob) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSON encodes values with encoding/json.
+type JSON struct{}
+
+func (JSON) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
+
+func (JSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// COMPRESS_THRESHOLD is the default size above which Compressed compresses.
+const COMPRESS_THRESHOLD = 256
+
+// The first byte of a Compressed encoding.
+const (
+	UNCOMPRESSED byte = iota
+	SNAPPY
+)
+
+// Compressed compresses the output of another codec with snappy once it's
+// larger than Threshold bytes (COMPRESS_THRESHOLD if 0), unless that doesn't
+// make it smaller.
+type Compressed struct {
+	Codec     Codec
+	Threshold int
+}
+
+func (c *Compressed) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	start := len(dst)
+	dst, err := c.Codec.Marshal(append(dst, UNCOMPRESSED), v)
+	if err != nil {
+		return dst[:start], err
+	}
+
+	threshold := c.Threshold
+	if threshold <= 0 {
+		threshold = COMPRESS_THRESHOLD
+	}
+	raw := dst[start+1:]
+	if len(raw) <= threshold {
+		return dst, nil
+	}
+	compressed := snappy.Encode(nil, raw)
+	if len(compressed) >= len(raw) {
+		return dst, nil
+	}
+	return append(append(dst[:start], SNAPPY), compressed...), nil
+}
+
+func (c *Compressed) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return ErrTruncated
+	}
+	switch data[0] {
+	case UNCOMPRESSED:
+		return c.Codec.Unmarshal(data[1:], v)
+	case SNAPPY:
+		raw, err := snappy.Decode(nil, data[1:])
+		if err != nil {
+			return err
+		}
+		return c.Codec.Unmarshal(raw, v)
+	}
+	return ErrFormat
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Typed stores values of type V in a store through a codec, so callers don't
+// marshal or type assert. Byte caches and slabs can be used through
+// store.FromBytes and store.FromSlab.
+type Typed[V any] struct {
+	store store.Store
+	codec Codec
+}
+
+func NewTyped[V any](s store.Store, codec Codec) *Typed[V] {
+	return &Typed[V]{store: s, codec: codec}
+}
+
+// Get returns store.ErrNoValue on a miss.
+func (t *Typed[V]) Get(key string) (V, error) {
+	var value V
+	data, err := t.store.Get(key)
+	if err != nil {
+		return value, err
+	}
+	err = t.codec.Unmarshal(data, &value)
+	return value, err
+}
+
+func (t *Typed[V]) Set(key string, value V) error {
+	data, err := t.codec.Marshal(nil, value)
+	if err != nil {
+		return err
+	}
+	return t.store.Set(key, data)
+}
+
+func (t *Typed[V]) Del(key string) error {
+	return t.store.Del(key)
+}
@@ -0,0 +1,196 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karlmcguire/experiments-cache/pkg/slab"
+	"github.com/karlmcguire/experiments-cache/pkg/store"
+)
+
+type (
+	inner struct {
+		Tags  []string
+		Extra *inner
+	}
+
+	user struct {
+		Name    string
+		Age     int
+		Score   float64
+		Active  bool
+		Data    []byte
+		Counts  map[string]uint32
+		Inner   inner
+		Created time.Time
+		hidden  int
+	}
+)
+
+func testUser() user {
+	return user{
+		Name:    "gopher",
+		Age:     -12,
+		Score:   99.5,
+		Active:  true,
+		Data:    []byte{1, 2, 3},
+		Counts:  map[string]uint32{"a": 1, "b": 300},
+		Inner:   inner{Tags: []string{"x", "y"}, Extra: &inner{}},
+		Created: time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for name, codec := range map[string]Codec{
+		"gob":               Gob{},
+		"json":              JSON{},
+		"binary":            Binary{},
+		"compressed-binary": &Compressed{Codec: Binary{}, Threshold: 16},
+	} {
+		original := testUser()
+		original.hidden = 1
+		prefix := []byte("prefix")
+		data, err := codec.Marshal(prefix, original)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.HasPrefix(data, prefix) {
+			t.Fatalf("%s: expected Marshal to append", name)
+		}
+
+		var decoded user
+		if err := codec.Unmarshal(data[len(prefix):], &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// unexported fields aren't encoded
+		original.hidden = 0
+		// gob and json don't keep the empty pointer, or nil and empty apart
+		if name == "gob" || name == "json" {
+			original.Inner.Extra = decoded.Inner.Extra
+		}
+		if !reflect.DeepEqual(decoded, original) {
+			t.Fatalf("%s: expected %+v, got %+v", name, original, decoded)
+		}
+	}
+}
+
+func TestBinaryNil(t *testing.T) {
+	type nils struct {
+		Slice []int
+		Empty []int
+		Map   map[int]int
+		Ptr   *int
+	}
+	original := nils{Empty: []int{}}
+	data, _ := Binary{}.Marshal(nil, original)
+	decoded := nils{Slice: []int{1}, Ptr: new(int)}
+	if err := (Binary{}).Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, original) {
+		t.Fatalf("expected %+v, got %+v", original, decoded)
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	if _, err := (Binary{}).Marshal(nil, struct{ F func() }{}); err != ErrType {
+		t.Fatal("expected ErrType for funcs")
+	}
+	if _, err := (Binary{}).Marshal(nil, nil); err != ErrType {
+		t.Fatal("expected ErrType for nil")
+	}
+	var u user
+	if err := (Binary{}).Unmarshal(nil, u); err != ErrType {
+		t.Fatal("expected ErrType for non-pointers")
+	}
+
+	data, _ := Binary{}.Marshal(nil, testUser())
+	for i := 0; i < len(data); i++ {
+		if err := (Binary{}).Unmarshal(data[:i], &u); err == nil {
+			t.Fatalf("expected error on data truncated to %d bytes", i)
+		}
+	}
+	if err := (Binary{}).Unmarshal(append(data, 0), &u); err != ErrTruncated {
+		t.Fatal("expected error on trailing data")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	data, _ := Bytes{}.Marshal(nil, "string")
+	data, _ = Bytes{}.Marshal(data, []byte(" bytes"))
+	var s string
+	var b []byte
+	Bytes{}.Unmarshal(data, &s)
+	Bytes{}.Unmarshal(data, &b)
+	if s != "string bytes" || string(b) != s {
+		t.Fatal("bytes error")
+	}
+	if _, err := (Bytes{}).Marshal(nil, 1); err != ErrType {
+		t.Fatal("expected ErrType")
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	c := &Compressed{Codec: Bytes{}}
+	small, _ := c.Marshal(nil, "small")
+	if small[0] != UNCOMPRESSED {
+		t.Fatal("expected small values to be uncompressed")
+	}
+	large, _ := c.Marshal(nil, strings.Repeat("large", 1000))
+	if large[0] != SNAPPY || len(large) > 1000 {
+		t.Fatal("expected large values to be compressed")
+	}
+
+	var s string
+	if err := c.Unmarshal(large, &s); err != nil || s != strings.Repeat("large", 1000) {
+		t.Fatal("decompression error")
+	}
+	if err := c.Unmarshal([]byte{9}, &s); err != ErrFormat {
+		t.Fatal("expected ErrFormat")
+	}
+}
+
+func TestTyped(t *testing.T) {
+	s, err := slab.New(&slab.Config{Size: 1 << 20, Buckets: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for name, s := range map[string]store.Store{
+		"store": store.NewMapStore(16),
+		"slab":  store.FromSlab(s),
+	} {
+		users := NewTyped[user](s, &Compressed{Codec: Binary{}})
+		if err := users.Set("gopher", testUser()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		u, err := users.Get("gopher")
+		if err != nil || !reflect.DeepEqual(u, testUser()) {
+			t.Fatalf("%s: get error %v", name, err)
+		}
+		users.Del("gopher")
+		if _, err := users.Get("gopher"); err != store.ErrNoValue {
+			t.Fatalf("%s: expected ErrNoValue, got %v", name, err)
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec Codec) {
+	u := testUser()
+	data, _ := codec.Marshal(nil, u)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		data, _ = codec.Marshal(data[:0], u)
+		codec.Unmarshal(data, &u)
+	}
+}
+
+func BenchmarkGob(b *testing.B)    { benchmarkCodec(b, Gob{}) }
+func BenchmarkJSON(b *testing.B)   { benchmarkCodec(b, JSON{}) }
+func BenchmarkBinary(b *testing.B) { benchmarkCodec(b, Binary{}) }
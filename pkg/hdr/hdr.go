@@ -0,0 +1,133 @@
+// Package hdr is a log-linear latency histogram in the style of HdrHistogram:
+// values are recorded into buckets with a bounded relative error (under 1%)
+// across the whole int64 range, so tail percentiles stay accurate without
+// storing every sample.
+package hdr
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SUB_BITS is the number of bits of precision kept for each value.
+	SUB_BITS = 8
+	SUB_SIZE = 1 << SUB_BITS
+	SUB_HALF = SUB_SIZE / 2
+	// BUCKETS covers every non-negative int64.
+	BUCKETS = (63-SUB_BITS)*SUB_HALF + SUB_SIZE
+)
+
+// Histogram records durations. Recording is safe for concurrent use, although
+// a histogram per goroutine (combined with Merge) avoids contention on hot
+// buckets.
+type Histogram struct {
+	counts [BUCKETS]uint64
+	total  uint64
+	sum    uint64
+	max    int64
+}
+
+func New() *Histogram {
+	return &Histogram{}
+}
+
+// index returns the bucket of v. Values below SUB_SIZE get their own bucket,
+// above that each power of two is split into SUB_HALF buckets.
+func index(v uint64) int {
+	if v < SUB_SIZE {
+		return int(v)
+	}
+	e := uint(bits.Len64(v) - SUB_BITS)
+	return int(e)*SUB_HALF + int(v>>e)
+}
+
+// highest returns the largest value in bucket i.
+func highest(i int) uint64 {
+	if i < SUB_SIZE {
+		return uint64(i)
+	}
+	e := uint(i/SUB_HALF - 1)
+	m := uint64(i - int(e)*SUB_HALF)
+	return (m+1)<<e - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddUint64(&h.counts[index(uint64(d))], 1)
+	atomic.AddUint64(&h.total, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Merge adds the values recorded by other into h.
+func (h *Histogram) Merge(other *Histogram) {
+	for i := range other.counts {
+		if count := atomic.LoadUint64(&other.counts[i]); count != 0 {
+			atomic.AddUint64(&h.counts[i], count)
+		}
+	}
+	atomic.AddUint64(&h.total, atomic.LoadUint64(&other.total))
+	atomic.AddUint64(&h.sum, atomic.LoadUint64(&other.sum))
+	if max := atomic.LoadInt64(&other.max); max > atomic.LoadInt64(&h.max) {
+		atomic.StoreInt64(&h.max, max)
+	}
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.total)
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.max))
+}
+
+func (h *Histogram) Mean() time.Duration {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadUint64(&h.sum) / total)
+}
+
+// Percentile returns the value below which p (0 to 1) of the recorded values
+// fall, rounded up to the top of its bucket.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	target := uint64(p*float64(total) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	seen := uint64(0)
+	for i := range h.counts {
+		seen += atomic.LoadUint64(&h.counts[i])
+		if seen >= target {
+			value := time.Duration(highest(i))
+			if max := h.Max(); value > max {
+				value = max
+			}
+			return value
+		}
+	}
+	return h.Max()
+}
+
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.total, 0)
+	atomic.StoreUint64(&h.sum, 0)
+	atomic.StoreInt64(&h.max, 0)
+}
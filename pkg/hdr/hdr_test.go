@@ -0,0 +1,83 @@
+package hdr
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	last := -1
+	for v := uint64(0); v < 1<<20; v++ {
+		i := index(v)
+		if i != last && i != last+1 {
+			t.Fatalf("%d: index %d skipped from %d", v, i, last)
+		}
+		if v > highest(i) || (i > 0 && v <= highest(i-1)) {
+			t.Fatalf("%d: outside bucket %d", v, i)
+		}
+		last = i
+	}
+	if index(1<<63-1) != BUCKETS-1 {
+		t.Fatal("max index error")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	h := New()
+	for i := 1; i <= 10000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	for p, want := range map[float64]time.Duration{
+		0.5:   5000 * time.Microsecond,
+		0.99:  9900 * time.Microsecond,
+		0.999: 9990 * time.Microsecond,
+	} {
+		got := h.Percentile(p)
+		if got < want || float64(got-want) > float64(want)*0.01 {
+			t.Fatalf("p%v: got %v want %v", p, got, want)
+		}
+	}
+	if h.Percentile(1) != h.Max() || h.Max() != 10000*time.Microsecond {
+		t.Fatal("max error")
+	}
+	if h.Count() != 10000 || h.Mean() != 5000500*time.Nanosecond {
+		t.Fatal("count error")
+	}
+
+	h.Reset()
+	if h.Count() != 0 || h.Percentile(0.5) != 0 || h.Max() != 0 {
+		t.Fatal("reset error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var (
+		wg     sync.WaitGroup
+		shared = New()
+		merged = New()
+		mu     sync.Mutex
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			local := New()
+			for i := 0; i < 1000; i++ {
+				d := time.Duration(g*1000 + i)
+				shared.Record(d)
+				local.Record(d)
+			}
+			mu.Lock()
+			merged.Merge(local)
+			mu.Unlock()
+		}(g)
+	}
+	wg.Wait()
+	if shared.Count() != 8000 || merged.Count() != 8000 {
+		t.Fatal("count error")
+	}
+	if shared.Percentile(0.5) != merged.Percentile(0.5) || merged.Max() != 7999 {
+		t.Fatal("merge error")
+	}
+}
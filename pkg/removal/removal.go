@@ -0,0 +1,91 @@
+// Package removal delivers notifications of values leaving a cache. Caches
+// collect removals in a Notifier while holding their lock and deliver them
+// after unlocking, so listeners can be slow (closing files, writing back
+// dirty values) or call back into the cache without stalling or deadlocking
+// it.
+package removal
+
+type Reason int
+
+const (
+	// SIZE removals make room for new values.
+	SIZE Reason = iota
+	// EXPIRED removals are values whose TTL passed.
+	EXPIRED
+	// EXPLICIT removals are from Del.
+	EXPLICIT
+	// REPLACED removals are old values overwritten by Set.
+	REPLACED
+	// REJECTED removals are new values the admission policy refused to store.
+	REJECTED
+)
+
+func (r Reason) String() string {
+	switch r {
+	case SIZE:
+		return "size"
+	case EXPIRED:
+		return "expired"
+	case EXPLICIT:
+		return "explicit"
+	case REPLACED:
+		return "replaced"
+	case REJECTED:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// Evicted returns true if the cache decided to remove the value, rather than
+// it being removed by a Del or Set.
+func (r Reason) Evicted() bool {
+	return r == SIZE || r == EXPIRED || r == REJECTED
+}
+
+// Listener is called with each removed key and value.
+type Listener func(key string, value interface{}, reason Reason)
+
+type Removal struct {
+	Key    string
+	Value  interface{}
+	Reason Reason
+}
+
+// Notifier collects removals for a cache. It isn't safe for concurrent use,
+// all methods should be called with the cache's lock held.
+type Notifier struct {
+	listener Listener
+	pending  []Removal
+}
+
+func (n *Notifier) Listen(listener Listener) {
+	n.listener = listener
+}
+
+// Add records a removal if there's a listener.
+func (n *Notifier) Add(key string, value interface{}, reason Reason) {
+	if n.listener == nil {
+		return
+	}
+	n.pending = append(n.pending, Removal{key, value, reason})
+}
+
+// Flush takes the pending removals, to be delivered once the lock is released.
+func (n *Notifier) Flush() Delivery {
+	delivery := Delivery{n.listener, n.pending}
+	n.pending = nil
+	return delivery
+}
+
+// Delivery is a batch of removals taken from a Notifier.
+type Delivery struct {
+	listener Listener
+	removals []Removal
+}
+
+// Deliver calls the listener with each removal, in the order they happened.
+func (d Delivery) Deliver() {
+	for _, r := range d.removals {
+		d.listener(r.Key, r.Value, r.Reason)
+	}
+}
@@ -0,0 +1,45 @@
+package removal
+
+import (
+	"testing"
+)
+
+func TestNotifier(t *testing.T) {
+	var n Notifier
+
+	// nothing is collected without a listener
+	n.Add("1", 1, SIZE)
+	n.Flush().Deliver()
+
+	removed := make([]Removal, 0)
+	n.Listen(func(key string, value interface{}, reason Reason) {
+		removed = append(removed, Removal{key, value, reason})
+	})
+	n.Add("2", 2, EXPIRED)
+	n.Add("3", 3, REJECTED)
+	delivery := n.Flush()
+	n.Add("4", 4, EXPLICIT)
+	if len(removed) != 0 {
+		t.Fatal("delivered before Deliver")
+	}
+
+	delivery.Deliver()
+	if len(removed) != 2 || removed[0] != (Removal{"2", 2, EXPIRED}) ||
+		removed[1] != (Removal{"3", 3, REJECTED}) {
+		t.Fatal("delivery error")
+	}
+	n.Flush().Deliver()
+	if len(removed) != 3 || removed[2].Reason != EXPLICIT {
+		t.Fatal("second delivery error")
+	}
+}
+
+func TestReason(t *testing.T) {
+	for reason, evicted := range map[Reason]bool{
+		SIZE: true, EXPIRED: true, REJECTED: true, EXPLICIT: false, REPLACED: false,
+	} {
+		if reason.Evicted() != evicted || reason.String() == "unknown" {
+			t.Fatalf("%v error", reason)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package slab
+
+// mmap isn't supported on this platform so memory always comes from the heap
+func alloc(size int, mmap bool) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func free(data []byte, mmap bool) error {
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package slab
+
+import (
+	"syscall"
+)
+
+func alloc(size int, mmap bool) ([]byte, error) {
+	if !mmap {
+		return make([]byte, size), nil
+	}
+	return syscall.Mmap(
+		-1, 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE,
+	)
+}
+
+func free(data []byte, mmap bool) error {
+	if !mmap || data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
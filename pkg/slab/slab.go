@@ -0,0 +1,312 @@
+package slab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
+
+const (
+	// HEADER_SIZE is the size of each entry header:
+	//
+	// [0:8]   key hash
+	// [8:10]  key length
+	// [10:14] value length
+	// [14:16] unused
+	HEADER_SIZE = 16
+	// ALIGN is the alignment of entries within a bucket. Because it's the same
+	// as the header size, headers never wrap around the end of a bucket.
+	ALIGN = 16
+	// MAX_KEY is the longest key that can be stored.
+	MAX_KEY = 1<<16 - 1
+	// MAX_BUCKET is the largest bucket size, offsets are stored as uint32.
+	MAX_BUCKET = 1 << 32
+)
+
+var ErrConfig = errors.New("invalid slab config")
+
+type Config struct {
+	// Size is the total number of bytes preallocated across all buckets.
+	Size int
+	// Buckets is the number of independently locked buckets, rounded up to a
+	// power of two.
+	Buckets int
+	// Mmap allocates bucket memory with anonymous mmap (outside of the Go
+	// heap) on platforms that support it.
+	Mmap bool
+}
+
+// Slab is a byte-oriented cache that keeps entries serialized in large
+// preallocated []byte buckets. Each bucket is indexed by a pointer-free
+// map[uint64]uint32 of key hashes to offsets, so the garbage collector never
+// has to scan the entries themselves (see the BigCache and FreeCache notes in
+// the README).
+//
+// Buckets are ring buffers: new entries are written at the head and space is
+// reclaimed from the tail. Eviction is CLOCK (second chance) over offsets,
+// entries that were read since they were last written are moved to the head
+// rather than being dropped.
+type Slab struct {
+	buckets []*bucket
+	mask    uint64
+	mmap    bool
+}
+
+type bucket struct {
+	sync.RWMutex
+	data     []byte
+	size     uint64
+	index    map[uint64]uint32
+	accessed []uint32
+	head     uint64
+	tail     uint64
+	scratch  []byte
+}
+
+func New(config *Config) (*Slab, error) {
+	count := util.Near(uint64(config.Buckets))
+	if count == 0 {
+		count = 1
+	}
+	// bucket sizes are rounded down to the alignment
+	size := uint64(config.Size) / count / ALIGN * ALIGN
+	if size == 0 || size > MAX_BUCKET {
+		return nil, ErrConfig
+	}
+
+	s := &Slab{
+		buckets: make([]*bucket, count),
+		mask:    count - 1,
+		mmap:    config.Mmap,
+	}
+	for i := range s.buckets {
+		data, err := alloc(int(size), config.Mmap)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.buckets[i] = &bucket{
+			data:     data,
+			size:     size,
+			index:    make(map[uint64]uint32),
+			accessed: make([]uint32, size/ALIGN/32+1),
+		}
+	}
+	return s, nil
+}
+
+// Close releases the bucket memory if it was mmap'd. The slab can't be used
+// afterwards.
+func (s *Slab) Close() error {
+	var err error
+	for _, b := range s.buckets {
+		if b == nil {
+			continue
+		}
+		if e := free(b.data, s.mmap); e != nil {
+			err = e
+		}
+		b.data = nil
+	}
+	return err
+}
+
+func (s *Slab) bucket(hash uint64) *bucket {
+	// use the upper bits for picking buckets so they're independent of the
+	// bits used by the index map
+	return s.buckets[(hash>>32)&s.mask]
+}
+
+// Get appends the value of key to dst and returns it along with true if the
+// key was found.
+func (s *Slab) Get(dst, key []byte) ([]byte, bool) {
+	hash := util.Hash64(key)
+	return s.bucket(hash).get(dst, key, hash)
+}
+
+// Set stores a copy of the key-value pair and returns false if the entry is
+// too large for a bucket.
+func (s *Slab) Set(key, value []byte) bool {
+	hash := util.Hash64(key)
+	return s.bucket(hash).set(key, value, hash)
+}
+
+// Del removes the key. Its space is reclaimed once the tail of the bucket
+// reaches it.
+func (s *Slab) Del(key []byte) {
+	hash := util.Hash64(key)
+	s.bucket(hash).del(key, hash)
+}
+
+// Len returns the number of entries.
+func (s *Slab) Len() int {
+	n := 0
+	for _, b := range s.buckets {
+		b.RLock()
+		n += len(b.index)
+		b.RUnlock()
+	}
+	return n
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func align(n uint64) uint64 {
+	return (n + ALIGN - 1) / ALIGN * ALIGN
+}
+
+func (b *bucket) header(off uint64) (hash uint64, keyLen, valLen uint64) {
+	h := b.data[off : off+HEADER_SIZE]
+	return binary.LittleEndian.Uint64(h[0:8]),
+		uint64(binary.LittleEndian.Uint16(h[8:10])),
+		uint64(binary.LittleEndian.Uint32(h[10:14]))
+}
+
+// read appends n bytes starting at off to dst, wrapping around the end.
+func (b *bucket) read(dst []byte, off, n uint64) []byte {
+	off %= b.size
+	if off+n <= b.size {
+		return append(dst, b.data[off:off+n]...)
+	}
+	dst = append(dst, b.data[off:]...)
+	return append(dst, b.data[:n-(b.size-off)]...)
+}
+
+// write copies src starting at off, wrapping around the end.
+func (b *bucket) write(off uint64, src []byte) {
+	off %= b.size
+	n := uint64(copy(b.data[off:], src))
+	copy(b.data, src[n:])
+}
+
+// equal compares the n bytes starting at off with key.
+func (b *bucket) equal(off uint64, key []byte) bool {
+	off %= b.size
+	n := uint64(len(key))
+	if off+n <= b.size {
+		return bytes.Equal(b.data[off:off+n], key)
+	}
+	first := b.size - off
+	return bytes.Equal(b.data[off:], key[:first]) &&
+		bytes.Equal(b.data[:n-first], key[first:])
+}
+
+// access sets the accessed bit for the entry at off. This is safe to call
+// while holding the read lock.
+func (b *bucket) access(off uint64) {
+	word, bit := &b.accessed[off/ALIGN/32], uint32(1)<<(off/ALIGN%32)
+	for {
+		old := atomic.LoadUint32(word)
+		if old&bit != 0 || atomic.CompareAndSwapUint32(word, old, old|bit) {
+			return
+		}
+	}
+}
+
+// clear resets the accessed bit for the entry at off and returns its previous
+// value.
+func (b *bucket) clear(off uint64) bool {
+	word, bit := &b.accessed[off/ALIGN/32], uint32(1)<<(off/ALIGN%32)
+	old := atomic.LoadUint32(word)
+	atomic.StoreUint32(word, old&^bit)
+	return old&bit != 0
+}
+
+func (b *bucket) get(dst, key []byte, hash uint64) ([]byte, bool) {
+	b.RLock()
+	defer b.RUnlock()
+
+	off32, exists := b.index[hash]
+	if !exists {
+		return dst, false
+	}
+	off := uint64(off32)
+
+	// make sure it's not a different key with the same hash
+	_, keyLen, valLen := b.header(off)
+	if keyLen != uint64(len(key)) || !b.equal(off+HEADER_SIZE, key) {
+		return dst, false
+	}
+
+	b.access(off)
+	return b.read(dst, off+HEADER_SIZE+keyLen, valLen), true
+}
+
+func (b *bucket) set(key, value []byte, hash uint64) bool {
+	n := align(HEADER_SIZE + uint64(len(key)) + uint64(len(value)))
+	if len(key) > MAX_KEY || n > b.size {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// the old entry (if any) becomes garbage that's reclaimed at the tail
+	delete(b.index, hash)
+
+	// make room for the new entry
+	for b.size-(b.head-b.tail) < n {
+		b.evict()
+	}
+
+	var header [HEADER_SIZE]byte
+	binary.LittleEndian.PutUint64(header[0:8], hash)
+	binary.LittleEndian.PutUint16(header[8:10], uint16(len(key)))
+	binary.LittleEndian.PutUint32(header[10:14], uint32(len(value)))
+
+	off := b.head % b.size
+	b.write(off, header[:])
+	b.write(off+HEADER_SIZE, key)
+	b.write(off+HEADER_SIZE+uint64(len(key)), value)
+	b.clear(off)
+	b.index[hash] = uint32(off)
+	b.head += n
+	return true
+}
+
+// evict reclaims the entry at the tail. Live entries that were accessed get a
+// second chance and are moved to the head instead.
+func (b *bucket) evict() {
+	off := b.tail % b.size
+	hash, keyLen, valLen := b.header(off)
+	n := align(HEADER_SIZE + keyLen + valLen)
+
+	current, exists := b.index[hash]
+	live := exists && uint64(current) == off
+
+	if live && b.clear(off) {
+		// moving the entry frees exactly as much space as it uses
+		b.scratch = b.read(b.scratch[:0], off, n)
+		b.tail += n
+		head := b.head % b.size
+		b.write(head, b.scratch)
+		b.clear(head)
+		b.index[hash] = uint32(head)
+		b.head += n
+		return
+	}
+
+	if live {
+		delete(b.index, hash)
+	}
+	b.tail += n
+}
+
+func (b *bucket) del(key []byte, hash uint64) {
+	b.Lock()
+	defer b.Unlock()
+
+	off, exists := b.index[hash]
+	if !exists {
+		return
+	}
+
+	_, keyLen, _ := b.header(uint64(off))
+	if keyLen == uint64(len(key)) && b.equal(uint64(off)+HEADER_SIZE, key) {
+		delete(b.index, hash)
+	}
+}
@@ -0,0 +1,127 @@
+package slab
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSlab(t *testing.T) {
+	s, err := New(&Config{Size: 1 << 16, Buckets: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Set([]byte("1"), []byte("one"))
+	if value, ok := s.Get(nil, []byte("1")); !ok || string(value) != "one" {
+		t.Fatal("set/get error")
+	}
+
+	s.Set([]byte("1"), []byte("uno"))
+	if value, _ := s.Get(nil, []byte("1")); string(value) != "uno" {
+		t.Fatal("overwrite error")
+	}
+
+	s.Del([]byte("1"))
+	if _, ok := s.Get(nil, []byte("1")); ok || s.Len() != 0 {
+		t.Fatal("del error")
+	}
+
+	if s.Set([]byte("big"), make([]byte, 1<<16)) {
+		t.Fatal("entry larger than bucket stored")
+	}
+}
+
+func TestSlabEvict(t *testing.T) {
+	// a single bucket holding 8 entries of 64 bytes
+	s, err := New(&Config{Size: 512, Buckets: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := make([]byte, 64-HEADER_SIZE-1)
+	for i := 0; i < 8; i++ {
+		s.Set([]byte(fmt.Sprintf("%d", i)), value)
+	}
+
+	// accessed entries get a second chance
+	s.Get(nil, []byte("0"))
+	s.Set([]byte("8"), value)
+
+	if _, ok := s.Get(nil, []byte("0")); !ok {
+		t.Fatal("accessed entry evicted")
+	}
+	if _, ok := s.Get(nil, []byte("1")); ok {
+		t.Fatal("oldest entry not evicted")
+	}
+	if s.Len() != 8 {
+		t.Fatal("capacity error")
+	}
+}
+
+func TestSlabWrap(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		s, err := New(&Config{Size: 1 << 12, Buckets: 2, Mmap: mmap})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// random entry sizes make entries wrap around the end of buckets, every
+		// entry that's found should have the last value set
+		values := make(map[string][]byte)
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("%d", rand.Intn(256))
+			value := make([]byte, rand.Intn(200))
+			rand.Read(value)
+			s.Set([]byte(key), value)
+			values[key] = value
+
+			key = fmt.Sprintf("%d", rand.Intn(256))
+			if found, ok := s.Get(nil, []byte(key)); ok &&
+				!bytes.Equal(found, values[key]) {
+				t.Fatal("wrong value")
+			}
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSlab(b *testing.B) {
+	s, _ := New(&Config{Size: 1 << 24, Buckets: 256})
+	defer s.Close()
+
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%d", i))
+		s.Set(keys[i], keys[i])
+	}
+
+	b.SetBytes(1)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var dst []byte
+		for i := 0; pb.Next(); i++ {
+			dst, _ = s.Get(dst[:0], keys[i&1023])
+		}
+	})
+}
+
+func TestSlabAllocs(t *testing.T) {
+	s, err := New(&Config{Size: 1 << 20, Buckets: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	key := []byte("key")
+	s.Set(key, []byte("value"))
+	dst := make([]byte, 0, 64)
+	if n := testing.AllocsPerRun(100, func() { s.Get(dst[:0], key) }); n != 0 {
+		t.Fatalf("expected no allocations on a hit, got %v", n)
+	}
+}
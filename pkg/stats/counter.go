@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
+
+// stripe is padded to a cache line so stripes don't false share.
+type stripe struct {
+	n uint64
+	_ [56]byte
+}
+
+// Counter is a striped uint64 counter. Adds go to one of several stripes
+// (picked by hashing an address on the goroutine's stack, so each goroutine
+// mostly hits the same stripe) and reads sum the stripes, so hot counters
+// don't bounce a single cache line between cores.
+type Counter struct {
+	stripes []stripe
+	mask    uintptr
+}
+
+func NewCounter() *Counter {
+	stripes := util.Near(uint64(runtime.GOMAXPROCS(0) * 2))
+	return &Counter{
+		stripes: make([]stripe, stripes),
+		mask:    uintptr(stripes - 1),
+	}
+}
+
+func (c *Counter) Add(n uint64) {
+	var local byte
+	atomic.AddUint64(&c.stripes[index(uintptr(unsafe.Pointer(&local)))&c.mask].n, n)
+}
+
+func (c *Counter) Value() uint64 {
+	sum := uint64(0)
+	for i := range c.stripes {
+		sum += atomic.LoadUint64(&c.stripes[i].n)
+	}
+	return sum
+}
+
+func (c *Counter) Reset() {
+	for i := range c.stripes {
+		atomic.StoreUint64(&c.stripes[i].n, 0)
+	}
+}
+
+// index hashes a stack address with the splitmix64 finalizer. Goroutine stacks
+// are far apart, so the high bits tell goroutines apart.
+func index(p uintptr) uintptr {
+	x := uint64(p)
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return uintptr(x ^ (x >> 31))
+}
@@ -0,0 +1,45 @@
+// Package expvarstats publishes cache stats as expvar variables. Every cache is
+// an entry of the "caches" map, so they all show up under /debug/vars:
+//
+//	{"caches": {"users": {"hits": 10, "misses": 2, ...}, ...}}
+package expvarstats
+
+import (
+	"expvar"
+
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+)
+
+var caches = expvar.NewMap("caches")
+
+// Publish adds (or replaces) the named cache. Stats are snapshotted each time
+// the variable is read.
+func Publish(name string, source stats.Source) {
+	caches.Set(name, expvar.Func(func() interface{} {
+		return Values(source.Stats())
+	}))
+}
+
+// Remove stops publishing the named cache.
+func Remove(name string) {
+	caches.Delete(name)
+}
+
+// Values flattens a snapshot into the published fields.
+func Values(s stats.Stats) map[string]interface{} {
+	values := map[string]interface{}{
+		"hits":         s.Hits,
+		"misses":       s.Misses,
+		"hit_ratio":    s.HitRatio(),
+		"sets":         s.Sets,
+		"rejections":   s.Rejections,
+		"cost_added":   s.CostAdded,
+		"cost_evicted": s.CostEvicted,
+		"dropped":      s.Dropped,
+		"drains":       s.Drains,
+	}
+	for cause, n := range s.Evictions {
+		values["evictions_"+stats.Cause(cause).String()] = n
+	}
+	return values
+}
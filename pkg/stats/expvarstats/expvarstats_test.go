@@ -0,0 +1,37 @@
+package expvarstats
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+)
+
+type source struct{ stats stats.Stats }
+
+func (s *source) Stats() stats.Stats { return s.stats }
+
+func TestPublish(t *testing.T) {
+	users := &source{}
+	Publish("users", users)
+	Publish("sessions", &source{})
+	users.stats.Hits = 3
+	users.stats.Evictions[stats.EXPIRED] = 2
+
+	var published map[string]map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("caches").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published["users"]["hits"] != 3 || published["users"]["evictions_expired"] != 2 {
+		t.Fatal("published values error")
+	}
+	if _, ok := published["sessions"]; !ok {
+		t.Fatal("missing cache")
+	}
+
+	Remove("sessions")
+	if caches.Get("sessions") != nil {
+		t.Fatal("remove error")
+	}
+}
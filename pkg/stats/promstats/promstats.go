@@ -0,0 +1,132 @@
+// Package promstats serves cache stats in the Prometheus text exposition
+// format, with each cache labelled by name:
+//
+//	handler := promstats.New("myapp_cache")
+//	handler.Register("users", users)
+//	http.Handle("/metrics", handler)
+package promstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+)
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(stats.Stats) float64
+}
+
+func counter(name, help string, value func(stats.Stats) uint64) metric {
+	return metric{name + "_total", "counter", help, func(s stats.Stats) float64 {
+		return float64(value(s))
+	}}
+}
+
+var metrics = []metric{
+	counter("hits", "Number of Gets that found a value.",
+		func(s stats.Stats) uint64 { return s.Hits }),
+	counter("misses", "Number of Gets that didn't find a value.",
+		func(s stats.Stats) uint64 { return s.Misses }),
+	counter("sets", "Number of Sets.",
+		func(s stats.Stats) uint64 { return s.Sets }),
+	counter("rejections", "Number of Sets rejected by the admission policy.",
+		func(s stats.Stats) uint64 { return s.Rejections }),
+	counter("cost_added", "Total cost of admitted values.",
+		func(s stats.Stats) uint64 { return s.CostAdded }),
+	counter("cost_evicted", "Total cost of evicted values.",
+		func(s stats.Stats) uint64 { return s.CostEvicted }),
+	counter("buffer_dropped", "Number of accesses lost from lossy buffers.",
+		func(s stats.Stats) uint64 { return s.Dropped }),
+	counter("buffer_drains", "Number of access buffer drains.",
+		func(s stats.Stats) uint64 { return s.Drains }),
+	{"hit_ratio", "gauge", "Hits divided by Gets since the cache was created.",
+		func(s stats.Stats) float64 { return s.HitRatio() }},
+}
+
+// Handler is an http.Handler serving the stats of registered caches.
+type Handler struct {
+	sync.RWMutex
+	namespace string
+	sources   map[string]stats.Source
+}
+
+// New returns a handler prefixing metric names with namespace.
+func New(namespace string) *Handler {
+	return &Handler{
+		namespace: namespace,
+		sources:   make(map[string]stats.Source),
+	}
+}
+
+// Register adds (or replaces) the named cache.
+func (h *Handler) Register(name string, source stats.Source) {
+	h.Lock()
+	defer h.Unlock()
+	h.sources[name] = source
+}
+
+func (h *Handler) Unregister(name string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.sources, name)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	h.Write(w)
+}
+
+// Write writes the stats of all registered caches, sorted by name.
+func (h *Handler) Write(w io.Writer) error {
+	h.RLock()
+	names := make([]string, 0, len(h.sources))
+	for name := range h.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// snapshot once per cache so every metric comes from the same snapshot
+	snapshots := make([]stats.Stats, len(names))
+	for i, name := range names {
+		snapshots[i] = h.sources[name].Stats()
+	}
+	h.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		name := h.namespace + "_" + m.name
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.kind)
+		for i, cache := range names {
+			fmt.Fprintf(buf, "%s{cache=\"%s\"} %v\n",
+				name, escape(cache), m.value(snapshots[i]))
+		}
+	}
+
+	name := h.namespace + "_evictions_total"
+	fmt.Fprintf(buf, "# HELP %s Number of evicted values by cause.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+	for i, cache := range names {
+		for cause, n := range snapshots[i].Evictions {
+			fmt.Fprintf(buf, "%s{cache=\"%s\",cause=\"%s\"} %d\n",
+				name, escape(cache), stats.Cause(cause), n)
+		}
+	}
+	return buf.Flush()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes a label value.
+func escape(value string) string {
+	return escaper.Replace(value)
+}
@@ -0,0 +1,47 @@
+package promstats
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+)
+
+type source struct{ stats stats.Stats }
+
+func (s *source) Stats() stats.Stats { return s.stats }
+
+func TestHandler(t *testing.T) {
+	handler := New("test_cache")
+	users := &source{stats.Stats{Hits: 3, Misses: 1}}
+	users.stats.Evictions[stats.SIZE] = 7
+	handler.Register("users", users)
+	handler.Register(`we"ird`, &source{})
+	handler.Register("removed", &source{})
+	handler.Unregister("removed")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Header().Get("Content-Type") != CONTENT_TYPE {
+		t.Fatal("content type error")
+	}
+	body, _ := ioutil.ReadAll(recorder.Body)
+	output := string(body)
+
+	for _, line := range []string{
+		"# TYPE test_cache_hits_total counter",
+		`test_cache_hits_total{cache="users"} 3`,
+		`test_cache_hit_ratio{cache="users"} 0.75`,
+		`test_cache_evictions_total{cache="users",cause="size"} 7`,
+		`test_cache_hits_total{cache="we\"ird"} 0`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "removed") {
+		t.Fatal("unregister error")
+	}
+}
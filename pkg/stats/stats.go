@@ -0,0 +1,142 @@
+// Package stats keeps cache statistics in striped counters and snapshots them
+// into a Stats value.
+package stats
+
+type Cause int
+
+// Causes of eviction.
+const (
+	// SIZE evictions make room for new entries (capacity or cost bound).
+	SIZE Cause = iota
+	// EXPIRED evictions remove entries whose TTL passed.
+	EXPIRED
+	CAUSES
+)
+
+func (c Cause) String() string {
+	switch c {
+	case SIZE:
+		return "size"
+	case EXPIRED:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Stats is a point in time snapshot of a cache's counters. Counters are read
+// one at a time, so a snapshot taken under load may be slightly inconsistent
+// (e.g. Hits+Misses a few short of the number of Gets).
+type Stats struct {
+	Hits       uint64
+	Misses     uint64
+	Sets       uint64
+	Rejections uint64
+	// Evictions is indexed by Cause.
+	Evictions   [CAUSES]uint64
+	CostAdded   uint64
+	CostEvicted uint64
+	// Dropped is the number of accesses lost from LOSSY buffer stripes before
+	// they were drained.
+	Dropped uint64
+	// Drains is the number of access buffer stripes drained into the policy.
+	Drains uint64
+}
+
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// TotalEvictions sums evictions over all causes.
+func (s Stats) TotalEvictions() uint64 {
+	total := uint64(0)
+	for _, n := range s.Evictions {
+		total += n
+	}
+	return total
+}
+
+// Source is implemented by caches exposing their stats.
+type Source interface {
+	Stats() Stats
+}
+
+// Buffer is implemented by ring.Buffer.
+type Buffer interface {
+	Drains() uint64
+	Dropped() uint64
+}
+
+// Recorder holds the counters of a single cache.
+type Recorder struct {
+	hits        *Counter
+	misses      *Counter
+	sets        *Counter
+	rejections  *Counter
+	evictions   [CAUSES]*Counter
+	costAdded   *Counter
+	costEvicted *Counter
+}
+
+func NewRecorder() *Recorder {
+	r := &Recorder{
+		hits:        NewCounter(),
+		misses:      NewCounter(),
+		sets:        NewCounter(),
+		rejections:  NewCounter(),
+		costAdded:   NewCounter(),
+		costEvicted: NewCounter(),
+	}
+	for i := range r.evictions {
+		r.evictions[i] = NewCounter()
+	}
+	return r
+}
+
+// Get records a hit or a miss.
+func (r *Recorder) Get(hit bool) {
+	if hit {
+		r.hits.Add(1)
+	} else {
+		r.misses.Add(1)
+	}
+}
+
+// Set records a set of an entry with the given cost, or a rejection if it
+// wasn't admitted.
+func (r *Recorder) Set(cost uint64, admitted bool) {
+	r.sets.Add(1)
+	if !admitted {
+		r.rejections.Add(1)
+		return
+	}
+	r.costAdded.Add(cost)
+}
+
+func (r *Recorder) Evict(cause Cause, cost uint64) {
+	r.evictions[cause].Add(1)
+	r.costEvicted.Add(cost)
+}
+
+// Snapshot reads the counters, along with the drain and drop counts of the
+// cache's access buffers.
+func (r *Recorder) Snapshot(buffers ...Buffer) Stats {
+	s := Stats{
+		Hits:        r.hits.Value(),
+		Misses:      r.misses.Value(),
+		Sets:        r.sets.Value(),
+		Rejections:  r.rejections.Value(),
+		CostAdded:   r.costAdded.Value(),
+		CostEvicted: r.costEvicted.Value(),
+	}
+	for i, counter := range r.evictions {
+		s.Evictions[i] = counter.Value()
+	}
+	for _, buffer := range buffers {
+		s.Drains += buffer.Drains()
+		s.Dropped += buffer.Dropped()
+	}
+	return s
+}
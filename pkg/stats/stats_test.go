@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+type testBuffer struct{ drains, dropped uint64 }
+
+func (b *testBuffer) Drains() uint64  { return b.drains }
+func (b *testBuffer) Dropped() uint64 { return b.dropped }
+
+func TestCounter(t *testing.T) {
+	var (
+		wg      sync.WaitGroup
+		counter = NewCounter()
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				counter.Add(2)
+			}
+		}()
+	}
+	wg.Wait()
+	if counter.Value() != 16000 {
+		t.Fatal("counter sum error")
+	}
+	counter.Reset()
+	if counter.Value() != 0 {
+		t.Fatal("counter reset error")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	r.Get(true)
+	r.Get(true)
+	r.Get(true)
+	r.Get(false)
+	r.Set(5, true)
+	r.Set(7, false)
+	r.Evict(SIZE, 2)
+	r.Evict(EXPIRED, 3)
+	r.Evict(EXPIRED, 1)
+
+	s := r.Snapshot(&testBuffer{1, 2}, &testBuffer{3, 4})
+	if s.Hits != 3 || s.Misses != 1 || s.HitRatio() != 0.75 {
+		t.Fatal("get error")
+	}
+	if s.Sets != 2 || s.Rejections != 1 || s.CostAdded != 5 {
+		t.Fatal("set error")
+	}
+	if s.Evictions[SIZE] != 1 || s.Evictions[EXPIRED] != 2 ||
+		s.TotalEvictions() != 3 || s.CostEvicted != 6 {
+		t.Fatal("evict error")
+	}
+	if s.Drains != 4 || s.Dropped != 6 {
+		t.Fatal("buffer error")
+	}
+	if (Stats{}).HitRatio() != 0 {
+		t.Fatal("empty hit ratio error")
+	}
+}
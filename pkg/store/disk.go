@@ -0,0 +1,689 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// HEADER_SIZE is the size of a record header: crc (4), seq (8), key length
+	// (4) and value length (4).
+	HEADER_SIZE = 20
+	// TOMBSTONE is the value length of a Del record.
+	TOMBSTONE = 1<<32 - 1
+	// SEGMENT_SIZE is the default size segments are rotated at.
+	SEGMENT_SIZE = 64 << 20
+
+	SEGMENT_EXT = ".seg"
+	TEMP_EXT    = ".tmp"
+	// COMPACT_FILE lists the segments replaced by a compaction, so they can be
+	// deleted on open if the compaction was interrupted.
+	COMPACT_FILE = "COMPACT"
+)
+
+var (
+	ErrCorrupt = errors.New("corrupt record")
+	ErrClosed  = errors.New("store closed")
+	ErrTooBig  = errors.New("key or value too big")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type (
+	DiskConfig struct {
+		// SegmentSize is the size at which the active segment is closed and a
+		// new one started.
+		SegmentSize int64
+		// Sync calls fsync after every write.
+		Sync bool
+		// CompactRatio triggers a compaction when a segment is rotated and the
+		// fraction of dead bytes in closed segments is above it (0 disables
+		// automatic compaction).
+		CompactRatio float64
+	}
+
+	// diskEntry is where the latest record of a key is.
+	diskEntry struct {
+		seq     uint64
+		segment uint64
+		offset  int64
+		size    uint32
+	}
+
+	diskSegment struct {
+		id   uint64
+		file *os.File
+		size int64
+	}
+
+	// DiskStore is a log-structured Store. Records are appended to segment
+	// files, with an in-memory index of the latest record for each key. Every
+	// record carries a sequence number so that the newest record for a key
+	// wins on recovery regardless of which segment it's in, which lets
+	// compaction write its output to new segments and delete the old ones
+	// without a crash leaving stale values behind.
+	//
+	// Record layout (little endian):
+	//
+	//	crc | seq | key length | value length | key | value
+	//
+	// The crc covers everything after it. Del appends a tombstone record with
+	// a value length of TOMBSTONE and no value.
+	DiskStore struct {
+		sync.RWMutex
+		dir      string
+		config   DiskConfig
+		index    map[string]*diskEntry
+		segments map[uint64]*diskSegment
+		active   *diskSegment
+		writer   *bufio.Writer
+		seq      uint64
+		// live is the number of bytes of records still in the index
+		live int64
+		// err is the first rotation or compaction failure, returned by Close
+		// since the writes triggering them succeeded
+		err    error
+		closed bool
+	}
+)
+
+// NewDiskStore opens (or creates) a store in dir, recovering the index from
+// the existing segments. Torn writes at the end of the last segment are
+// truncated.
+func NewDiskStore(dir string, config *DiskConfig) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &DiskStore{
+		dir:      dir,
+		config:   *config,
+		index:    make(map[string]*diskEntry),
+		segments: make(map[uint64]*diskSegment),
+		// 0 is never used, so it can mean no tombstone during replay
+		seq: 1,
+	}
+	if s.config.SegmentSize <= 0 {
+		s.config.SegmentSize = SEGMENT_SIZE
+	}
+
+	if err := s.recover(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DiskStore) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", id, SEGMENT_EXT))
+}
+
+// recover finishes or discards interrupted compactions, then replays every
+// segment in order.
+func (s *DiskStore) recover() error {
+	if err := s.finishCompaction(); err != nil {
+		return err
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+SEGMENT_EXT))
+	if err != nil {
+		return err
+	}
+	ids := make([]uint64, 0, len(names))
+	for _, name := range names {
+		id, err := strconv.ParseUint(
+			strings.TrimSuffix(filepath.Base(name), SEGMENT_EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	tombstones := make(map[string]uint64)
+	for i, id := range ids {
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		segment := &diskSegment{id: id, file: file}
+		s.segments[id] = segment
+
+		end, err := s.replay(segment, tombstones)
+		if err != nil {
+			return err
+		}
+		segment.size = end
+		// a torn write can only be at the end of the last segment
+		if i == len(ids)-1 {
+			if err := file.Truncate(end); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the last segment stays active, unless it's full
+	if len(ids) > 0 && s.segments[ids[len(ids)-1]].size < s.config.SegmentSize {
+		s.activate(s.segments[ids[len(ids)-1]])
+		return nil
+	}
+	next := uint64(0)
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	return s.create(next)
+}
+
+// replay reads the records of a segment into the index, returning the offset
+// after the last valid record.
+func (s *DiskStore) replay(segment *diskSegment, tombstones map[string]uint64) (int64, error) {
+	if _, err := segment.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(segment.file)
+	offset := int64(0)
+
+	for {
+		seq, key, size, length, err := readRecord(reader)
+		if err != nil {
+			// EOF, or a torn or corrupt record (everything after it is lost)
+			return offset, nil
+		}
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+
+		if size == TOMBSTONE {
+			if seq > tombstones[key] {
+				tombstones[key] = seq
+			}
+			if entry, exists := s.index[key]; exists && entry.seq < seq {
+				s.live -= HEADER_SIZE + int64(len(key)) + int64(entry.size)
+				delete(s.index, key)
+			}
+		} else if entry, exists := s.index[key]; (!exists || entry.seq < seq) &&
+			tombstones[key] < seq {
+			if exists {
+				s.live -= HEADER_SIZE + int64(len(key)) + int64(entry.size)
+			}
+			s.index[key] = &diskEntry{seq, segment.id, offset, size}
+			s.live += length
+		}
+		offset += length
+	}
+}
+
+// readRecord reads and checks the next record, returning its length.
+func readRecord(r io.Reader) (seq uint64, key string, size uint32, length int64, err error) {
+	header := make([]byte, HEADER_SIZE)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	seq = binary.LittleEndian.Uint64(header[4:])
+	keyLen := binary.LittleEndian.Uint32(header[12:])
+	size = binary.LittleEndian.Uint32(header[16:])
+	valLen := size
+	if size == TOMBSTONE {
+		valLen = 0
+	}
+	if int64(keyLen)+int64(valLen) > 1<<31 {
+		err = ErrCorrupt
+		return
+	}
+
+	body := make([]byte, keyLen+valLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, body)
+	if crc != binary.LittleEndian.Uint32(header) {
+		err = ErrCorrupt
+		return
+	}
+	return seq, string(body[:keyLen]), size, HEADER_SIZE + int64(len(body)), nil
+}
+
+// encode builds a record. A nil value with tombstone set builds a tombstone.
+func encode(seq uint64, key string, value []byte, tombstone bool) []byte {
+	record := make([]byte, HEADER_SIZE+len(key)+len(value))
+	binary.LittleEndian.PutUint64(record[4:], seq)
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(key)))
+	if tombstone {
+		binary.LittleEndian.PutUint32(record[16:], TOMBSTONE)
+	} else {
+		binary.LittleEndian.PutUint32(record[16:], uint32(len(value)))
+	}
+	copy(record[HEADER_SIZE:], key)
+	copy(record[HEADER_SIZE+len(key):], value)
+	binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+	return record
+}
+
+func (s *DiskStore) activate(segment *diskSegment) {
+	segment.file.Seek(segment.size, io.SeekStart)
+	s.active = segment
+	s.writer = bufio.NewWriter(segment.file)
+}
+
+// syncDir makes the files created, renamed or removed in the directory so far
+// durable.
+func (s *DiskStore) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *DiskStore) create(id uint64) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := s.syncDir(); err != nil {
+		file.Close()
+		os.Remove(s.segmentPath(id))
+		return err
+	}
+	segment := &diskSegment{id: id, file: file}
+	s.segments[id] = segment
+	s.activate(segment)
+	return nil
+}
+
+// append writes a record to the active segment. The record is flushed to the
+// file (so it can be read) but only synced if configured.
+func (s *DiskStore) append(record []byte) (*diskSegment, int64, error) {
+	segment, offset := s.active, s.active.size
+	if _, err := s.writer.Write(record); err != nil {
+		return nil, 0, err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return nil, 0, err
+	}
+	if s.config.Sync {
+		if err := segment.file.Sync(); err != nil {
+			return nil, 0, err
+		}
+	}
+	segment.size += int64(len(record))
+	return segment, offset, nil
+}
+
+// rotated is called once a write has succeeded and been indexed, so a failure
+// to rotate doesn't fail the write. The first failure is returned by Close.
+func (s *DiskStore) rotated() {
+	if err := s.rotate(); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// rotate starts a new segment if the active one is full. It's called once the
+// index is updated, so a compaction it triggers moves the appended record.
+func (s *DiskStore) rotate() error {
+	if s.active.size < s.config.SegmentSize {
+		return nil
+	}
+	if err := s.active.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.create(s.active.id + 1); err != nil {
+		return err
+	}
+	if s.config.CompactRatio > 0 {
+		if total := s.closedSize(); total > 0 &&
+			float64(total-s.closedLive())/float64(total) > s.config.CompactRatio {
+			return s.compact()
+		}
+	}
+	return nil
+}
+
+// closedSize returns the total size of the segments that aren't active.
+func (s *DiskStore) closedSize() int64 {
+	total := int64(0)
+	for id, segment := range s.segments {
+		if id != s.active.id {
+			total += segment.size
+		}
+	}
+	return total
+}
+
+// closedLive returns the size of the indexed records in closed segments.
+func (s *DiskStore) closedLive() int64 {
+	live := int64(0)
+	for key, entry := range s.index {
+		if entry.segment != s.active.id {
+			live += HEADER_SIZE + int64(len(key)) + int64(entry.size)
+		}
+	}
+	return live
+}
+
+func (s *DiskStore) Get(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	entry, exists := s.index[key]
+	if !exists {
+		return nil, ErrNoValue
+	}
+
+	record := make([]byte, HEADER_SIZE+len(key)+int(entry.size))
+	if _, err := s.segments[entry.segment].file.ReadAt(record, entry.offset); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(record[4:], crcTable) != binary.LittleEndian.Uint32(record) {
+		return nil, ErrCorrupt
+	}
+	return record[HEADER_SIZE+len(key):], nil
+}
+
+func (s *DiskStore) Set(key string, value []byte) error {
+	if int64(len(key)) > 1<<30 || int64(len(value)) >= 1<<30 {
+		return ErrTooBig
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	record := encode(s.seq, key, value, false)
+	segment, offset, err := s.append(record)
+	if err != nil {
+		return err
+	}
+
+	if old, exists := s.index[key]; exists {
+		s.live -= HEADER_SIZE + int64(len(key)) + int64(old.size)
+	}
+	s.index[key] = &diskEntry{s.seq, segment.id, offset, uint32(len(value))}
+	s.live += int64(len(record))
+	s.seq++
+	s.rotated()
+	return nil
+}
+
+// Del appends a tombstone for the key, if it exists.
+func (s *DiskStore) Del(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	old, exists := s.index[key]
+	if !exists {
+		return nil
+	}
+	if _, _, err := s.append(encode(s.seq, key, nil, true)); err != nil {
+		return err
+	}
+	s.seq++
+
+	delete(s.index, key)
+	s.live -= HEADER_SIZE + int64(len(key)) + int64(old.size)
+	s.rotated()
+	return nil
+}
+
+// Len returns the number of keys in the store.
+func (s *DiskStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.index)
+}
+
+// Size returns the total size of all segments and the size of the records
+// that are still live (the rest is reclaimed by compaction).
+func (s *DiskStore) Size() (total, live int64) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.closedSize() + s.active.size, s.live
+}
+
+// Compact rewrites the live records of all closed segments into new segments
+// and deletes the old ones. The active segment is left alone.
+func (s *DiskStore) Compact() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compact()
+}
+
+func (s *DiskStore) compact() error {
+	old := make([]uint64, 0, len(s.segments))
+	for id := range s.segments {
+		if id != s.active.id {
+			old = append(old, id)
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+	replaced := make(map[uint64]bool, len(old))
+	for _, id := range old {
+		replaced[id] = true
+	}
+
+	// copy live records in key order to new segments after the active one,
+	// tombstones in the old segments are dropped since every record they
+	// could hide is being dropped too
+	keys := make([]string, 0)
+	for key, entry := range s.index {
+		if replaced[entry.segment] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var (
+		next    = s.active.id + 1
+		written = make([]*diskSegment, 0)
+		moved   = make(map[string]*diskEntry, len(keys))
+		file    *os.File
+		writer  *bufio.Writer
+		size    int64
+	)
+	finish := func() error {
+		if file == nil {
+			return nil
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		written[len(written)-1].size = size
+		file = nil
+		return nil
+	}
+	cleanup := func() {
+		for _, segment := range written {
+			segment.file.Close()
+			os.Remove(s.segmentPath(segment.id) + TEMP_EXT)
+			// renamed segments would make the next create fail
+			os.Remove(s.segmentPath(segment.id))
+		}
+	}
+
+	for _, key := range keys {
+		entry := s.index[key]
+		if file == nil || size >= s.config.SegmentSize {
+			if err := finish(); err != nil {
+				cleanup()
+				return err
+			}
+			var err error
+			file, err = os.OpenFile(s.segmentPath(next)+TEMP_EXT,
+				os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				cleanup()
+				return err
+			}
+			written = append(written, &diskSegment{id: next, file: file})
+			writer = bufio.NewWriter(file)
+			size = 0
+			next++
+		}
+
+		record := make([]byte, HEADER_SIZE+len(key)+int(entry.size))
+		if _, err := s.segments[entry.segment].file.ReadAt(record, entry.offset); err != nil {
+			cleanup()
+			return err
+		}
+		if _, err := writer.Write(record); err != nil {
+			cleanup()
+			return err
+		}
+		moved[key] = &diskEntry{entry.seq, next - 1, size, entry.size}
+		size += int64(len(record))
+	}
+	if err := finish(); err != nil {
+		cleanup()
+		return err
+	}
+
+	// the new segments are complete, once they're renamed a crash leaves both
+	// old and new records around, which replay resolves by sequence number
+	for _, segment := range written {
+		if err := os.Rename(segment.file.Name(), s.segmentPath(segment.id)); err != nil {
+			cleanup()
+			return err
+		}
+	}
+	if err := s.syncDir(); err != nil {
+		cleanup()
+		return err
+	}
+
+	// record which segments to delete, so an interrupted deletion can't leave
+	// old values without the tombstones hiding them
+	list := make([]string, len(old))
+	for i, id := range old {
+		list[i] = strconv.FormatUint(id, 10)
+	}
+	marker := filepath.Join(s.dir, COMPACT_FILE)
+	if err := ioutil.WriteFile(marker+TEMP_EXT, []byte(strings.Join(list, "\n")), 0644); err != nil {
+		os.Remove(marker + TEMP_EXT)
+		cleanup()
+		return err
+	}
+	if err := os.Rename(marker+TEMP_EXT, marker); err != nil {
+		os.Remove(marker + TEMP_EXT)
+		cleanup()
+		return err
+	}
+	// the old segments are only removed once the marker is durable
+	if err := s.syncDir(); err != nil {
+		// the marker may be durable, in which case the new segments have to
+		// stay unless the marker is known to be gone
+		os.Remove(marker)
+		if s.syncDir() == nil {
+			cleanup()
+		}
+		return err
+	}
+
+	for _, segment := range written {
+		s.segments[segment.id] = segment
+	}
+	for key, entry := range moved {
+		s.index[key] = entry
+	}
+	for _, id := range old {
+		s.segments[id].file.Close()
+		delete(s.segments, id)
+	}
+
+	// the next writes go after the compacted segments
+	if err := s.create(next); err != nil {
+		return err
+	}
+	return s.finishCompaction()
+}
+
+// finishCompaction deletes the segments listed by an interrupted compaction,
+// along with any temporary files.
+func (s *DiskStore) finishCompaction() error {
+	temps, err := filepath.Glob(filepath.Join(s.dir, "*"+TEMP_EXT))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		os.Remove(temp)
+	}
+
+	marker := filepath.Join(s.dir, COMPACT_FILE)
+	list, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(list), "\n") {
+		id, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// the marker has to outlive the segments it lists
+	if err := s.syncDir(); err != nil {
+		return err
+	}
+	return os.Remove(marker)
+}
+
+func (s *DiskStore) closeFiles() {
+	for _, segment := range s.segments {
+		segment.file.Close()
+	}
+}
+
+// Close syncs the active segment and closes all segment files. It also returns
+// the first failure to rotate or compact segments after a write, if any.
+func (s *DiskStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.active.file.Sync()
+	s.closeFiles()
+	if err == nil {
+		err = s.err
+	}
+	return err
+}
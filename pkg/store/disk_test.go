@@ -0,0 +1,264 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newDiskStore(t *testing.T, dir string, config *DiskConfig) *DiskStore {
+	s, err := NewDiskStore(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func expect(t *testing.T, s Store, key, value string) {
+	data, err := s.Get(key)
+	if value == "" {
+		if err != ErrNoValue {
+			t.Fatalf("%s: expected ErrNoValue, got %q %v", key, data, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	if string(data) != value {
+		t.Fatalf("%s: expected %q, got %q", key, value, data)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newDiskStore(t, dir, &DiskConfig{SegmentSize: 256})
+	for i := 0; i < 100; i++ {
+		if err := s.Set(fmt.Sprintf("%d", i), []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Set("1", []byte("changed"))
+	s.Del("2")
+	s.Del("missing")
+
+	expect(t, s, "0", "value 0")
+	expect(t, s, "1", "changed")
+	expect(t, s, "2", "")
+	if s.Len() != 99 {
+		t.Fatalf("expected 99 keys, got %d", s.Len())
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("0"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// everything survives a restart
+	s = newDiskStore(t, dir, &DiskConfig{SegmentSize: 256})
+	defer s.Close()
+	expect(t, s, "0", "value 0")
+	expect(t, s, "1", "changed")
+	expect(t, s, "2", "")
+	expect(t, s, "99", "value 99")
+	if s.Len() != 99 {
+		t.Fatalf("expected 99 keys, got %d", s.Len())
+	}
+}
+
+func TestDiskStoreCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newDiskStore(t, dir, &DiskConfig{SegmentSize: 256})
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 20; j++ {
+			s.Set(fmt.Sprintf("%d", j), []byte(fmt.Sprintf("value %d %d", i, j)))
+		}
+	}
+	for j := 10; j < 20; j++ {
+		s.Del(fmt.Sprintf("%d", j))
+	}
+
+	before, live := s.Size()
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := s.Size()
+	if after >= before || after < live {
+		t.Fatalf("expected size between %d and %d, got %d", live, before, after)
+	}
+	for j := 0; j < 20; j++ {
+		if j < 10 {
+			expect(t, s, fmt.Sprintf("%d", j), fmt.Sprintf("value 9 %d", j))
+		} else {
+			expect(t, s, fmt.Sprintf("%d", j), "")
+		}
+	}
+	s.Close()
+
+	// deleted keys stay deleted after compaction drops the tombstones
+	s = newDiskStore(t, dir, &DiskConfig{SegmentSize: 256})
+	defer s.Close()
+	for j := 0; j < 20; j++ {
+		if j < 10 {
+			expect(t, s, fmt.Sprintf("%d", j), fmt.Sprintf("value 9 %d", j))
+		} else {
+			expect(t, s, fmt.Sprintf("%d", j), "")
+		}
+	}
+}
+
+func TestDiskStoreAutoCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newDiskStore(t, dir, &DiskConfig{SegmentSize: 256, CompactRatio: 0.5})
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set("key", []byte(fmt.Sprintf("value %d", i)))
+	}
+	expect(t, s, "key", "value 999")
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+SEGMENT_EXT))
+	if len(segments) > 4 {
+		t.Fatalf("expected old segments to be compacted, found %d", len(segments))
+	}
+}
+
+// TestDiskStoreRotateCompact compacts on most writes, including the one that
+// fills a segment, so the written record must already be indexed.
+func TestDiskStoreRotateCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := &DiskConfig{SegmentSize: 64, CompactRatio: 0.1}
+	s := newDiskStore(t, dir, config)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("%d", i%10)
+		if i%3 == 0 {
+			if err := s.Del(key); err != nil {
+				t.Fatal(err)
+			}
+			expect(t, s, key, "")
+			continue
+		}
+		if err := s.Set(key, []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, s, key, fmt.Sprintf("value %d", i))
+	}
+	s.Close()
+
+	// deleted keys stay deleted after replaying the compacted segments
+	s = newDiskStore(t, dir, config)
+	defer s.Close()
+	for i := 190; i < 200; i++ {
+		key := fmt.Sprintf("%d", i%10)
+		if i%3 == 0 {
+			expect(t, s, key, "")
+		} else {
+			expect(t, s, key, fmt.Sprintf("value %d", i))
+		}
+	}
+}
+
+// TestDiskStoreRotateError checks that a write succeeds if the segment can't
+// be rotated after it, with the failure returned by Close.
+func TestDiskStoreRotateError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newDiskStore(t, dir, &DiskConfig{SegmentSize: 64})
+	// the next segment can't be created
+	if err := ioutil.WriteFile(s.segmentPath(s.active.id+1), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.Set(fmt.Sprintf("%d", i), []byte("value")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		expect(t, s, fmt.Sprintf("%d", i), "value")
+	}
+	if err := s.Close(); err == nil {
+		t.Fatal("rotation error not returned by Close")
+	}
+}
+
+func TestDiskStoreRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newDiskStore(t, dir, &DiskConfig{})
+	s.Set("a", []byte("1"))
+	s.Set("b", []byte("2"))
+	path := s.active.file.Name()
+	s.Close()
+
+	// a torn write at the end of the segment is dropped
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	s = newDiskStore(t, dir, &DiskConfig{})
+	expect(t, s, "a", "1")
+	expect(t, s, "b", "")
+	// and writes continue after the last valid record
+	s.Set("c", []byte("3"))
+	s.Close()
+
+	s = newDiskStore(t, dir, &DiskConfig{})
+	expect(t, s, "a", "1")
+	expect(t, s, "c", "3")
+	s.Close()
+
+	// a corrupt record and everything after it is dropped
+	data, _ := ioutil.ReadFile(path)
+	data[HEADER_SIZE+1+1+HEADER_SIZE] ^= 0xff
+	ioutil.WriteFile(path, data, 0644)
+	s = newDiskStore(t, dir, &DiskConfig{})
+	defer s.Close()
+	expect(t, s, "a", "1")
+	expect(t, s, "c", "")
+}
+
+func TestDiskStoreInterruptedCompaction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newDiskStore(t, dir, &DiskConfig{SegmentSize: 64})
+	for i := 0; i < 20; i++ {
+		s.Set(fmt.Sprintf("%d", i), []byte("value"))
+	}
+	s.Del("0")
+	s.Close()
+
+	// an unfinished compaction output and a pending deletion of the first
+	// segment (holding key 0 and its tombstone's target)
+	ioutil.WriteFile(filepath.Join(dir, "junk"+SEGMENT_EXT+TEMP_EXT), []byte("junk"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, COMPACT_FILE), []byte("0"), 0644)
+
+	s = newDiskStore(t, dir, &DiskConfig{SegmentSize: 64})
+	defer s.Close()
+	if _, err := os.Stat(filepath.Join(dir, COMPACT_FILE)); !os.IsNotExist(err) {
+		t.Fatal("expected compaction marker to be removed")
+	}
+	if temps, _ := filepath.Glob(filepath.Join(dir, "*"+TEMP_EXT)); len(temps) != 0 {
+		t.Fatalf("expected temporary files to be removed, found %v", temps)
+	}
+	expect(t, s, "0", "")
+	expect(t, s, "19", "value")
+}
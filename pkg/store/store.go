@@ -1,6 +1,11 @@
 package store
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/karlmcguire/experiments-cache/pkg/slab"
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
 
 var ErrNoValue = errors.New("no value associated with key")
 
@@ -37,3 +42,69 @@ func (s *mapStore) Del(key string) error {
 	delete(s.data, key)
 	return nil
 }
+
+// Bytes is implemented by caches storing []byte values, like cache.FastCache
+// and cache.BigCache.
+type Bytes interface {
+	GetBytes(dst, key []byte) ([]byte, bool)
+	SetBytes(key, value []byte)
+	DelBytes(key []byte)
+}
+
+type bytesStore struct {
+	cache Bytes
+}
+
+// FromBytes uses a cache storing []byte as a Store, so it can back a
+// codec.Typed. Keys aren't copied, the caches copy them on Set.
+func FromBytes(c Bytes) Store {
+	return &bytesStore{c}
+}
+
+func (s *bytesStore) Get(key string) ([]byte, error) {
+	data, ok := s.cache.GetBytes(nil, util.Bytes(key))
+	if !ok {
+		return nil, ErrNoValue
+	}
+	return data, nil
+}
+
+func (s *bytesStore) Set(key string, value []byte) error {
+	s.cache.SetBytes(util.Bytes(key), value)
+	return nil
+}
+
+func (s *bytesStore) Del(key string) error {
+	s.cache.DelBytes(util.Bytes(key))
+	return nil
+}
+
+type slabStore struct {
+	slab *slab.Slab
+}
+
+// FromSlab uses a slab as a Store. Set returns ErrTooBig for entries that
+// don't fit in a bucket.
+func FromSlab(s *slab.Slab) Store {
+	return &slabStore{s}
+}
+
+func (s *slabStore) Get(key string) ([]byte, error) {
+	data, ok := s.slab.Get(nil, util.Bytes(key))
+	if !ok {
+		return nil, ErrNoValue
+	}
+	return data, nil
+}
+
+func (s *slabStore) Set(key string, value []byte) error {
+	if !s.slab.Set(util.Bytes(key), value) {
+		return ErrTooBig
+	}
+	return nil
+}
+
+func (s *slabStore) Del(key string) error {
+	s.slab.Del(util.Bytes(key))
+	return nil
+}
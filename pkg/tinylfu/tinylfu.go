@@ -0,0 +1,205 @@
+package tinylfu
+
+import (
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
+
+const (
+	// SKETCH_DEPTH is the number of rows (hash functions) in the count-min
+	// sketch.
+	SKETCH_DEPTH = 4
+	// SAMPLE_MULTI is multiplied by the capacity to get the number of
+	// increments between each aging (reset) operation.
+	SAMPLE_MULTI = 10
+)
+
+// TinyLFU is a frequency-based admission policy. It estimates the access
+// frequency of keys with a count-min sketch of 4-bit counters, which is
+// periodically aged by halving every counter. A doorkeeper bloom filter sits in
+// front of the sketch so that keys only seen once never make it into the
+// counters.
+//
+// TinyLFU is not concurrent safe by itself, callers are expected to hold a lock
+// or batch accesses (see the BP-Wrapper notes in the README).
+//
+// See: https://arxiv.org/abs/1512.00727
+type TinyLFU struct {
+	sketch *sketch
+	door   *bloom
+	incrs  uint64
+	reset  uint64
+}
+
+// New returns a TinyLFU policy sized for a cache holding capacity entries.
+func New(capacity uint64) *TinyLFU {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TinyLFU{
+		sketch: newSketch(capacity),
+		door:   newBloom(capacity),
+		reset:  capacity * SAMPLE_MULTI,
+	}
+}
+
+// Increment records an access of the key hash.
+func (p *TinyLFU) Increment(hash uint64) {
+	// the first access only goes to the doorkeeper, this keeps one-hit wonders
+	// out of the sketch entirely
+	if p.door.add(hash) {
+		p.sketch.increment(hash)
+	}
+
+	// check if we should age the sketch
+	if p.incrs++; p.incrs >= p.reset {
+		p.Reset()
+	}
+}
+
+// Estimate returns the estimated access frequency of the key hash.
+func (p *TinyLFU) Estimate(hash uint64) uint64 {
+	estimate := p.sketch.estimate(hash)
+	if p.door.has(hash) {
+		estimate++
+	}
+	return estimate
+}
+
+// Admit returns true if the candidate should replace the victim, meaning that
+// the candidate has a higher estimated frequency.
+func (p *TinyLFU) Admit(candidate, victim uint64) bool {
+	return p.Estimate(candidate) > p.Estimate(victim)
+}
+
+// Reset halves every counter in the sketch and clears the doorkeeper so that
+// old popularity fades over time.
+func (p *TinyLFU) Reset() {
+	p.incrs = 0
+	p.sketch.halve()
+	p.door.clear()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// sketch is a count-min sketch with 4-bit counters (two per byte).
+type sketch struct {
+	rows [SKETCH_DEPTH][]byte
+	mask uint64
+}
+
+func newSketch(capacity uint64) *sketch {
+	// keep a minimum width so small caches don't collide on every counter
+	width := util.Near(capacity)
+	if width < 64 {
+		width = 64
+	}
+	s := &sketch{mask: width - 1}
+	for i := range s.rows {
+		s.rows[i] = make([]byte, width/2+1)
+	}
+	return s
+}
+
+// index returns the counter index of hash in row i using double hashing.
+func (s *sketch) index(hash uint64, i int) uint64 {
+	return (hash + uint64(i)*(hash>>32|1)) & s.mask
+}
+
+func (s *sketch) increment(hash uint64) {
+	for i := range s.rows {
+		n := s.index(hash, i)
+		// each byte holds two counters, the odd index uses the high nibble
+		shift := (n & 1) * 4
+		if v := (s.rows[i][n/2] >> shift) & 0x0f; v < 15 {
+			s.rows[i][n/2] += 1 << shift
+		}
+	}
+}
+
+func (s *sketch) estimate(hash uint64) uint64 {
+	min := byte(255)
+	for i := range s.rows {
+		n := s.index(hash, i)
+		if v := (s.rows[i][n/2] >> ((n & 1) * 4)) & 0x0f; v < min {
+			min = v
+		}
+	}
+	return uint64(min)
+}
+
+func (s *sketch) halve() {
+	for _, row := range s.rows {
+		for i := range row {
+			// halve both nibbles at once
+			row[i] = (row[i] >> 1) & 0x77
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// BLOOM_HASHES is the number of bits set per key in the doorkeeper.
+	BLOOM_HASHES = 3
+	// BLOOM_SEED is added to key hashes before they're remixed for the
+	// doorkeeper, so its bits don't collide along with the sketch counters.
+	BLOOM_SEED = 0x94d049bb133111eb
+)
+
+// bloom is a simple bloom filter used as the TinyLFU doorkeeper.
+type bloom struct {
+	bits []uint64
+	mask uint64
+}
+
+func newBloom(capacity uint64) *bloom {
+	// roughly 8 bits per entry keeps the false positive rate low with 3 hashes
+	size := util.Near(capacity * 8)
+	if size < 64 {
+		size = 64
+	}
+	return &bloom{
+		bits: make([]uint64, size/64),
+		mask: size - 1,
+	}
+}
+
+// seed remixes hash with the splitmix64 finalizer so doorkeeper indexes are
+// independent from the sketch indexes.
+func seed(hash uint64) uint64 {
+	hash += BLOOM_SEED
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	return hash ^ (hash >> 31)
+}
+
+// add sets the bits of hash and returns true if they were already set.
+func (b *bloom) add(hash uint64) bool {
+	hash = seed(hash)
+	exists := true
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		n := (hash + i*(hash>>32|1)) & b.mask
+		if b.bits[n/64]&(1<<(n%64)) == 0 {
+			exists = false
+			b.bits[n/64] |= 1 << (n % 64)
+		}
+	}
+	return exists
+}
+
+func (b *bloom) has(hash uint64) bool {
+	hash = seed(hash)
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		n := (hash + i*(hash>>32|1)) & b.mask
+		if b.bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) clear() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+}
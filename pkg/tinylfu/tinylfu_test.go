@@ -0,0 +1,62 @@
+package tinylfu
+
+import (
+	"testing"
+
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
+
+func TestTinyLFU(t *testing.T) {
+	p := New(64)
+	hot := util.Hash64([]byte("hot"))
+	cold := util.Hash64([]byte("cold"))
+
+	for i := 0; i < 8; i++ {
+		p.Increment(hot)
+	}
+	p.Increment(cold)
+
+	if p.Estimate(cold) != 1 {
+		t.Fatal("doorkeeper error")
+	}
+	if p.Admit(cold, hot) {
+		t.Fatal("admitted cold candidate")
+	}
+	if !p.Admit(hot, cold) {
+		t.Fatal("rejected hot candidate")
+	}
+
+	// aging should halve the sketch and clear the doorkeeper
+	p.Reset()
+	if p.Estimate(cold) != 0 || p.Estimate(hot) != 3 {
+		t.Fatal("reset error")
+	}
+}
+
+func TestTinyLFUSaturate(t *testing.T) {
+	p := New(1 << 20)
+	hash := util.Hash64([]byte("1"))
+	for i := 0; i < 100; i++ {
+		p.Increment(hash)
+	}
+	if p.Estimate(hash) != 16 {
+		t.Fatal("counter overflow")
+	}
+}
+
+func TestTinyLFUDoorkeeper(t *testing.T) {
+	p := New(100)
+	// hashes a multiple of both masks apart share every sketch counter
+	hash := util.Hash64([]byte("1"))
+	other := hash + p.door.mask + 1
+	for i := 0; i < SKETCH_DEPTH; i++ {
+		if p.sketch.index(hash, i) != p.sketch.index(other, i) {
+			t.Fatal("hashes don't collide in the sketch")
+		}
+	}
+
+	p.Increment(hash)
+	if p.door.has(other) {
+		t.Fatal("doorkeeper collides along with the sketch")
+	}
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"unsafe"
+
 	"github.com/minio/highwayhash"
 )
 
@@ -31,3 +33,19 @@ func Near(n uint64) uint64 {
 
 	return n
 }
+
+// String returns the bytes as a string without copying. The bytes must not be
+// modified while the string is in use, so it's only for passing []byte keys to
+// functions taking strings that don't keep them.
+func String(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// Bytes returns the string as bytes without copying. The bytes must not be
+// modified.
+func Bytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
+}
@@ -0,0 +1,156 @@
+package wheel
+
+import (
+	"sync"
+	"time"
+)
+
+// GRANULARITY is the time span of each bucket the caches use.
+const GRANULARITY = time.Second
+
+type bucket map[string]int64
+
+// Wheel is a bucketed timer wheel for expiring keys. Keys are grouped into
+// buckets by their expiration time so that expired keys can be found without
+// scanning every key in a cache, only the buckets that have passed.
+type Wheel struct {
+	sync.Mutex
+	buckets     map[int64]bucket
+	granularity int64
+	last        int64
+	stop        chan struct{}
+	once        sync.Once
+}
+
+// NewWheel returns a timer wheel with buckets spanning granularity.
+func NewWheel(granularity time.Duration) *Wheel {
+	if granularity <= 0 {
+		granularity = GRANULARITY
+	}
+	w := &Wheel{
+		buckets:     make(map[int64]bucket),
+		granularity: int64(granularity),
+		stop:        make(chan struct{}),
+	}
+	w.last = w.bucket(time.Now().UnixNano())
+	return w
+}
+
+func (w *Wheel) bucket(expiration int64) int64 {
+	return expiration / w.granularity
+}
+
+// Add records that key expires at expiration (unix nanoseconds).
+func (w *Wheel) Add(key string, expiration int64) {
+	if expiration == 0 {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	id := w.bucket(expiration)
+	// keys added after their bucket was cleaned go in the next one to be
+	// cleaned so they aren't lost
+	if id < w.last {
+		id = w.last
+	}
+	b, exists := w.buckets[id]
+	if !exists {
+		b = make(bucket)
+		w.buckets[id] = b
+	}
+	b[key] = expiration
+}
+
+// Del removes key from the bucket for expiration.
+func (w *Wheel) Del(key string, expiration int64) {
+	if expiration == 0 {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	id := w.bucket(expiration)
+	if id < w.last {
+		id = w.last
+	}
+	if b, exists := w.buckets[id]; exists {
+		delete(b, key)
+	}
+}
+
+// Expired removes and returns the keys of every bucket that ended before now.
+func (w *Wheel) Expired(now int64) []string {
+	w.Lock()
+	defer w.Unlock()
+
+	var keys []string
+	current := w.bucket(now)
+	// after a long pause (or a clock jump) there are fewer buckets than steps
+	// to the current one, so take the ones that ended and jump straight there
+	if current-w.last > int64(len(w.buckets)) {
+		for id, b := range w.buckets {
+			if id >= current {
+				continue
+			}
+			for key := range b {
+				keys = append(keys, key)
+			}
+			delete(w.buckets, id)
+		}
+		w.last = current
+	}
+	for ; w.last < current; w.last++ {
+		b, exists := w.buckets[w.last]
+		if !exists {
+			continue
+		}
+		for key := range b {
+			keys = append(keys, key)
+		}
+		delete(w.buckets, w.last)
+	}
+	return keys
+}
+
+// Start calls expire with the expired keys every granularity until Stop is
+// called. Keys are passed along even if they were set again with a different
+// expiration, so expire should check the entry before removing it.
+func (w *Wheel) Start(expire func([]string)) {
+	go func() {
+		ticker := time.NewTicker(time.Duration(w.granularity))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case now := <-ticker.C:
+				if keys := w.Expired(now.UnixNano()); len(keys) > 0 {
+					expire(keys)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the goroutine started by Start.
+func (w *Wheel) Stop() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+// Expiration returns the unix nanosecond expiration for ttl, or 0 if ttl <= 0
+// (never expires).
+func Expiration(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// IsExpired returns true if the expiration has passed.
+func IsExpired(expiration int64) bool {
+	return expiration != 0 && time.Now().UnixNano() >= expiration
+}
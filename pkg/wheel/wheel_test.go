@@ -0,0 +1,67 @@
+package wheel
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWheel(t *testing.T) {
+	w := NewWheel(time.Millisecond * 10)
+	now := time.Now().UnixNano()
+
+	w.Add("1", now+int64(time.Millisecond*15))
+	w.Add("2", now+int64(time.Millisecond*15))
+	w.Add("3", now+int64(time.Second))
+	w.Add("4", now+int64(time.Millisecond*15))
+	w.Del("4", now+int64(time.Millisecond*15))
+
+	if keys := w.Expired(now); len(keys) != 0 {
+		t.Fatal("expired too early")
+	}
+
+	keys := w.Expired(now + int64(time.Millisecond*40))
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "1" || keys[1] != "2" {
+		t.Fatalf("expired wrong keys: %v", keys)
+	}
+
+	// buckets should only be returned once
+	if keys := w.Expired(now + int64(time.Millisecond*40)); len(keys) != 0 {
+		t.Fatal("bucket not removed")
+	}
+}
+
+func TestWheelJump(t *testing.T) {
+	w := NewWheel(time.Nanosecond)
+	now := time.Now().UnixNano()
+	w.Add("1", now+int64(time.Hour))
+	w.Add("2", now+int64(time.Hour*24))
+
+	// stepping a nanosecond at a time would take forever
+	keys := w.Expired(now + int64(time.Hour*2))
+	if len(keys) != 1 || keys[0] != "1" {
+		t.Fatalf("expired wrong keys: %v", keys)
+	}
+	if keys := w.Expired(now + int64(time.Hour*48)); len(keys) != 1 || keys[0] != "2" {
+		t.Fatalf("expired wrong keys: %v", keys)
+	}
+}
+
+func TestWheelStart(t *testing.T) {
+	w := NewWheel(time.Millisecond)
+	defer w.Stop()
+
+	expired := make(chan []string, 1)
+	w.Start(func(keys []string) { expired <- keys })
+	w.Add("1", Expiration(time.Millisecond))
+
+	select {
+	case keys := <-expired:
+		if len(keys) != 1 || keys[0] != "1" {
+			t.Fatal("expired wrong keys")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("key never expired")
+	}
+}
@@ -17,6 +17,7 @@
 package ring
 
 import (
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -44,6 +45,8 @@ type Stripe struct {
 	head     int
 	capacity int
 	busy     int32
+	// drains is shared by all stripes of a Buffer
+	drains *uint64
 }
 
 func NewStripe(config *Config) *Stripe {
@@ -65,11 +68,16 @@ func (s *Stripe) Push(element Element) {
 		// copy elements and send to consumer
 		s.Consumer.Push(append(s.data[:0:0], s.data...))
 		s.head = 0
+		if s.drains != nil {
+			atomic.AddUint64(s.drains, 1)
+		}
 	}
 }
 
 type Config struct {
 	Consumer Consumer
+	// Stripes must be a power of two for LOSSLESS buffers. LOSSY buffers round
+	// it up to one, and use one stripe per P if it's 0.
 	Stripes  int
 	Capacity int
 }
@@ -82,9 +90,12 @@ type Config struct {
 type Buffer struct {
 	stripes []*Stripe
 	pool    *sync.Pool
+	next    uint32
 	push    func(*Buffer, Element)
-	rand    int
+	rand    uint64
 	mask    int
+	drains  uint64
+	dropped uint64
 }
 
 // NewBuffer returns a striped ring buffer. The Type can be either LOSSY or
@@ -92,32 +103,59 @@ type Buffer struct {
 // will be called when individual stripes are full and need to drain their
 // elements.
 func NewBuffer(Type BufferType, config *Config) *Buffer {
+	stripes, push := config.Stripes, pushLossless
 	if Type == LOSSY {
-		// LOSSY buffers use a very simple sync.Pool for concurrently reusing
-		// stripes. We do lose some stripes due to GC (unheld items in sync.Pool
-		// are cleared), but the performance gains generally outweigh the small
-		// percentage of elements lost. The performance primarily comes from
-		// low-level runtime functions used in the standard library that aren't
-		// available to us (such as runtime_procPin()).
-		return &Buffer{
-			pool: &sync.Pool{
-				New: func() interface{} { return NewStripe(config) },
-			},
-			push: pushLossy,
+		// LOSSY buffers drop elements rather than wait for a busy stripe, the
+		// elements only affect access order so it's worth a few being lost.
+		// There's a stripe per P so that's rare.
+		if stripes <= 0 {
+			stripes = runtime.GOMAXPROCS(0)
+		}
+		for n := 1; ; n <<= 1 {
+			if n >= stripes {
+				stripes = n
+				break
+			}
 		}
+		push = pushLossy
 	}
 
-	// unlike lossy, lossless manually handles all stripes
-	stripes := make([]*Stripe, config.Stripes)
-	for i := range stripes {
-		stripes[i] = NewStripe(config)
+	buffer := &Buffer{
+		stripes: make([]*Stripe, stripes),
+		mask:    stripes - 1,
+		rand:    uint64(time.Now().UnixNano()), // random seed for picking stripes
+		push:    push,
 	}
-	return &Buffer{
-		stripes: stripes,
-		mask:    config.Stripes - 1,
-		rand:    int(time.Now().UnixNano()), // random seed for picking stripes
-		push:    pushLossless,
+	for i := range buffer.stripes {
+		buffer.stripes[i] = NewStripe(config)
+		buffer.stripes[i].drains = &buffer.drains
 	}
+	if Type == LOSSY {
+		// LOSSY buffers use a very simple sync.Pool for picking stripes, which
+		// keeps goroutines on the same P pushing to the same stripe. The
+		// performance primarily comes from low-level runtime functions used in
+		// the standard library that aren't available to us (such as
+		// runtime_procPin()). The stripes are owned by the buffer, so the pool
+		// dropping one on GC doesn't lose its elements.
+		buffer.pool = &sync.Pool{
+			New: func() interface{} {
+				return buffer.stripes[int(atomic.AddUint32(&buffer.next, 1))&buffer.mask]
+			},
+		}
+	}
+	return buffer
+}
+
+// Drains returns the number of times a stripe was drained to the Consumer.
+func (b *Buffer) Drains() uint64 {
+	return atomic.LoadUint64(&b.drains)
+}
+
+// Dropped returns the number of elements LOSSY buffers dropped because their
+// stripe was busy, which happens when Ps share a stripe. It's always 0 for
+// LOSSLESS buffers.
+func (b *Buffer) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
 }
 
 // Push adds an element to one of the internal stripes and possibly drains if
@@ -125,19 +163,21 @@ func NewBuffer(Type BufferType, config *Config) *Buffer {
 func (b *Buffer) Push(element Element) { b.push(b, element) }
 
 func pushLossy(b *Buffer, element Element) {
-	// reuse or create a new stripe
+	// reuse the P's stripe or get another one
 	stripe := b.pool.Get().(*Stripe)
-	stripe.Push(element)
+	if atomic.CompareAndSwapInt32(&stripe.busy, 0, 1) {
+		stripe.Push(element)
+		atomic.StoreInt32(&stripe.busy, 0)
+	} else {
+		atomic.AddUint64(&b.dropped, 1)
+	}
 	b.pool.Put(stripe)
 }
 
 func pushLossless(b *Buffer, element Element) {
-	// xorshift random (racy but it's random enough)
-	b.rand ^= b.rand << 13
-	b.rand ^= b.rand >> 7
-	b.rand ^= b.rand << 17
+	start := b.random()
 	// try to find an available stripe
-	for i := b.rand & b.mask; ; i = (i + 1) & b.mask {
+	for i := start; ; i = (i + 1) & b.mask {
 		// try to get exclusive lock on the stripe
 		if atomic.CompareAndSwapInt32(&b.stripes[i].busy, 0, 1) {
 			b.stripes[i].Push(element)
@@ -145,5 +185,26 @@ func pushLossless(b *Buffer, element Element) {
 			atomic.StoreInt32(&b.stripes[i].busy, 0)
 			return
 		}
+		// every stripe is busy, let their goroutines finish (there may be
+		// fewer Ps than goroutines pushing)
+		if (i+1)&b.mask == start {
+			runtime.Gosched()
+		}
 	}
 }
+
+// random returns a random stripe. An atomic Weyl sequence is race free, and
+// mixing it spreads consecutive pushes over the stripes.
+func (b *Buffer) random() int {
+	return int(mix(atomic.AddUint64(&b.rand, 0x9e3779b97f4a7c15)) & uint64(b.mask))
+}
+
+// mix is the splitmix64 finalizer.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
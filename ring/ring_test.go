@@ -17,6 +17,7 @@
 package ring
 
 import (
+	"runtime"
 	"testing"
 )
 
@@ -51,6 +52,62 @@ func TestLossy(t *testing.T) {
 	buffer.Push("4")
 }
 
+func TestLossyDropped(t *testing.T) {
+	buffer := NewBuffer(LOSSY, &Config{
+		Consumer: &BaseConsumer{},
+		Stripes:  1,
+		Capacity: 4,
+	})
+	for i := 0; i < 6; i++ {
+		buffer.Push("1")
+	}
+	if buffer.Drains() != 1 || buffer.Dropped() != 0 {
+		t.Fatal("drain count error")
+	}
+	// pushes to a busy stripe are dropped
+	buffer.stripes[0].busy = 1
+	buffer.Push("1")
+	buffer.Push("1")
+	buffer.stripes[0].busy = 0
+	if buffer.Dropped() != 2 || buffer.stripes[0].head != 2 {
+		t.Fatal("dropped count error")
+	}
+}
+
+func TestLossyStripes(t *testing.T) {
+	buffer := NewBuffer(LOSSY, &Config{
+		Consumer: &BaseConsumer{},
+		Stripes:  3,
+		Capacity: 4,
+	})
+	if len(buffer.stripes) != 4 {
+		t.Fatal("stripe count not rounded to power of two")
+	}
+	buffer = NewBuffer(LOSSY, &Config{Consumer: &BaseConsumer{}, Capacity: 4})
+	if len(buffer.stripes) < runtime.GOMAXPROCS(0) {
+		t.Fatal("expected a stripe per P by default")
+	}
+}
+
+func TestLosslessDrains(t *testing.T) {
+	pushed := 0
+	buffer := NewBuffer(LOSSLESS, &Config{
+		Consumer: &TestConsumer{
+			push: func(elements []Element) {
+				pushed += len(elements)
+			},
+		},
+		Stripes:  1,
+		Capacity: 4,
+	})
+	for i := 0; i < 10; i++ {
+		buffer.Push("1")
+	}
+	if buffer.Drains() != 2 || pushed != 8 || buffer.Dropped() != 0 {
+		t.Fatal("drain count error")
+	}
+}
+
 func BenchmarkLossy(b *testing.B) {
 	buffer := NewBuffer(LOSSY, &Config{
 		Consumer: &BaseConsumer{},
@@ -0,0 +1,238 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	root "github.com/karlmcguire/experiments-cache"
+	"github.com/karlmcguire/experiments-cache/cache"
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+	"github.com/karlmcguire/experiments-cache/typed"
+)
+
+var ErrDone = errors.New("trace done")
+
+type (
+	// Trace returns the next key in a key stream, or ErrDone once the stream
+	// is finished.
+	Trace func() (string, error)
+
+	// Policy is a cache being simulated.
+	Policy interface {
+		// Get returns true on a hit.
+		Get(string) bool
+		// Set returns false if the key was rejected by an admission policy.
+		Set(string) bool
+		Del(string)
+		// Stats returns the cache's counters, for its evictions.
+		Stats() stats.Stats
+	}
+
+	// Factory creates a policy holding capacity entries.
+	Factory func(capacity int) Policy
+
+	Result struct {
+		Name       string
+		Capacity   int
+		Requests   uint64
+		Hits       uint64
+		Misses     uint64
+		Evictions  uint64
+		Rejections uint64
+	}
+)
+
+func (r *Result) HitRatio() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Requests)
+}
+
+// FromSlice returns a trace over the keys.
+func FromSlice(keys []string) Trace {
+	i := 0
+	return func() (string, error) {
+		if i >= len(keys) {
+			return "", ErrDone
+		}
+		i++
+		return keys[i-1], nil
+	}
+}
+
+// Policies returns factories for each bounded cache implementation.
+func Policies() map[string]Factory {
+	return map[string]Factory{
+		"lru": func(capacity int) Policy {
+			return FromCache(cache.NewMapCache(capacity))
+		},
+		"lru-wrap": func(capacity int) Policy {
+			return FromCache(cache.NewMapWrapCache(capacity))
+		},
+		"lru-lockfree": func(capacity int) Policy {
+			return FromCache(cache.NewLockFreeCache(capacity))
+		},
+		"lru-sharded": func(capacity int) Policy {
+			return FromCache(cache.NewShardedCache(capacity, 1))
+		},
+		"w-tinylfu": func(capacity int) Policy {
+			return FromCache(cache.NewWTinyLFU(capacity))
+		},
+		"sampled-tinylfu": func(capacity int) Policy {
+			return FromRoot(root.NewCache(uint64(capacity)))
+		},
+		"typed-lru": func(capacity int) Policy {
+			return FromTyped(typed.NewLRU[string, struct{}](capacity, typed.String[string]))
+		},
+		"typed-tinylfu": func(capacity int) Policy {
+			return FromTyped(typed.NewTinyLFU[string, struct{}](capacity, typed.String[string]))
+		},
+	}
+}
+
+// Simulate replays the trace against the policy. Each key is looked up and set
+// on a miss, like a demand-filled cache in front of a backend.
+func Simulate(policy Policy, trace Trace) (*Result, error) {
+	result := &Result{}
+
+	for {
+		key, err := trace()
+		if err == ErrDone {
+			result.Evictions = policy.Stats().TotalEvictions()
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		result.Requests++
+		if policy.Get(key) {
+			result.Hits++
+			continue
+		}
+		result.Misses++
+
+		if !policy.Set(key) {
+			result.Rejections++
+		}
+	}
+}
+
+// Run simulates each policy at the given capacity, calling trace for a fresh
+// key stream each time. Results are sorted by name.
+func Run(capacity int, trace func() Trace, policies map[string]Factory) ([]*Result, error) {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]*Result, 0, len(names))
+	for _, name := range names {
+		result, err := Simulate(policies[name](capacity), trace())
+		if err != nil {
+			return nil, err
+		}
+		result.Name, result.Capacity = name, capacity
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Table writes the results as an efficiency table.
+func Table(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "policy\tcapacity\trequests\thit ratio\tevictions\trejections\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f%%\t%d\t%d\t\n",
+			r.Name, r.Capacity, r.Requests, r.HitRatio()*100,
+			r.Evictions, r.Rejections)
+	}
+	return tw.Flush()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type cachePolicy struct {
+	cache cache.Cache
+}
+
+// FromCache wraps any implementation of the cache package's Cache interface.
+// CostCaches are set with a cost of 1 and report their rejections.
+func FromCache(c cache.Cache) Policy {
+	return &cachePolicy{c}
+}
+
+func (p *cachePolicy) Get(key string) bool {
+	return p.cache.Get(key) != nil
+}
+
+func (p *cachePolicy) Set(key string) bool {
+	if c, ok := p.cache.(cache.CostCache); ok {
+		return c.SetWithCost(key, key, 1)
+	}
+	p.cache.Set(key, key)
+	return true
+}
+
+func (p *cachePolicy) Del(key string) {
+	p.cache.Del(key)
+}
+
+func (p *cachePolicy) Stats() stats.Stats {
+	return p.cache.Stats()
+}
+
+type rootPolicy struct {
+	cache *root.Cache
+}
+
+// FromRoot wraps the root package's sampled TinyLFU Cache.
+func FromRoot(c *root.Cache) Policy {
+	return &rootPolicy{c}
+}
+
+func (p *rootPolicy) Get(key string) bool {
+	return p.cache.Get(key) != nil
+}
+
+func (p *rootPolicy) Set(key string) bool {
+	return p.cache.SetWithCost(key, key, 1)
+}
+
+// Del is a no-op, the root Cache doesn't support deletes.
+func (p *rootPolicy) Del(key string) {}
+
+func (p *rootPolicy) Stats() stats.Stats {
+	return p.cache.Stats()
+}
+
+type typedPolicy struct {
+	cache typed.Cache[string, struct{}]
+}
+
+// FromTyped wraps a typed cache, only keys are stored.
+func FromTyped(c typed.Cache[string, struct{}]) Policy {
+	return &typedPolicy{c}
+}
+
+func (p *typedPolicy) Get(key string) bool {
+	_, ok := p.cache.Get(key)
+	return ok
+}
+
+func (p *typedPolicy) Set(key string) bool {
+	return p.cache.Set(key, struct{}{})
+}
+
+func (p *typedPolicy) Del(key string) {
+	p.cache.Del(key)
+}
+
+func (p *typedPolicy) Stats() stats.Stats {
+	return p.cache.Stats()
+}
@@ -0,0 +1,80 @@
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	root "github.com/karlmcguire/experiments-cache"
+	"github.com/karlmcguire/experiments-cache/cache"
+)
+
+func TestSimulate(t *testing.T) {
+	// 4 distinct keys looped through 4 times, the first loop always misses
+	keys := make([]string, 0, 16)
+	for i := 0; i < 16; i++ {
+		keys = append(keys, fmt.Sprintf("%d", i%4))
+	}
+
+	result, err := Simulate(FromCache(cache.NewMapCache(4)), FromSlice(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hits != 12 || result.Misses != 4 || result.HitRatio() != 0.75 {
+		t.Fatal("hit ratio error")
+	}
+	if result.Evictions != 0 {
+		t.Fatal("eviction error")
+	}
+
+	// a loop one larger than an LRU cache never hits
+	result, _ = Simulate(FromCache(cache.NewMapCache(3)), FromSlice(keys))
+	if result.Hits != 0 || result.Evictions != 13 {
+		t.Fatal("lru loop error")
+	}
+}
+
+func TestSimulateRejections(t *testing.T) {
+	keys := make([]string, 0, 64)
+	for i := 0; i < 64; i++ {
+		keys = append(keys, fmt.Sprintf("%d", i))
+	}
+
+	result, _ := Simulate(FromRoot(root.NewCache(16)), FromSlice(keys))
+	if result.Rejections == 0 || result.Evictions+result.Rejections != 48 {
+		t.Fatal("rejection error")
+	}
+}
+
+func TestRun(t *testing.T) {
+	keys := make([]string, 0, 1024)
+	for i := 0; i < 1024; i++ {
+		keys = append(keys, fmt.Sprintf("%d", (i*i)%100))
+	}
+
+	results, err := Run(32, func() Trace { return FromSlice(keys) }, Policies())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(Policies()) {
+		t.Fatal("missing results")
+	}
+
+	var buf bytes.Buffer
+	if err := Table(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Requests != 1024 {
+			t.Fatal("requests error")
+		}
+		if !strings.Contains(buf.String(), result.Name) {
+			t.Fatal("table missing policy")
+		}
+		// every policy holds 32 of the 100 keys at most
+		if result.Misses-result.Rejections-result.Evictions > 32 {
+			t.Fatalf("%s: evictions not reported", result.Name)
+		}
+	}
+}
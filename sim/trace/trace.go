@@ -0,0 +1,223 @@
+// Package trace streams the standard cache trace formats into sim.Trace key
+// streams. Traces are read a line at a time, so multi-GB files are never held
+// in memory.
+package trace
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/karlmcguire/experiments-cache/sim"
+)
+
+const (
+	// LINE_MAX is the longest line accepted (Wikipedia URLs can be long).
+	LINE_MAX = 1 << 20
+	// BLOCK_SIZE is the sector size of the UMass storage traces.
+	BLOCK_SIZE = 512
+)
+
+var ErrFormat = errors.New("invalid trace format")
+
+// Reader parses a trace format into a key stream.
+type Reader func(io.Reader) sim.Trace
+
+// Formats maps format names to their readers.
+var Formats = map[string]Reader{
+	"arc":       ARC,
+	"lirs":      LIRS,
+	"wikipedia": Wikipedia,
+	"umass":     UMass,
+}
+
+// Open opens a trace file with the given format, transparently decompressing
+// it if it's gzipped. The returned closer must be called once the trace is no
+// longer needed.
+func Open(path string, format Reader) (sim.Trace, io.Closer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := Decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return format(r), file, nil
+}
+
+// Decompress wraps r in a gzip reader if it starts with the gzip magic bytes,
+// otherwise r is returned (buffered) as is.
+func Decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err == io.EOF || (err == nil && (magic[0] != 0x1f || magic[1] != 0x8b)) {
+		return buffered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gzip.NewReader(buffered)
+}
+
+// Keys collects the first n keys of a trace (or all of them if n <= 0) so
+// traces can be used by benchmarks expecting a key slice.
+func Keys(trace sim.Trace, n int) ([]string, error) {
+	keys := make([]string, 0)
+	for n <= 0 || len(keys) < n {
+		key, err := trace()
+		if err == sim.ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// keys are the keys of a trace line, either listed or a run of count block
+// numbers from start. Runs are generated a key at a time, so a line can't
+// make the reader allocate more than its own length.
+type keys struct {
+	list         []string
+	start, count uint64
+}
+
+func (k *keys) empty() bool {
+	return len(k.list) == 0 && k.count == 0
+}
+
+func (k *keys) next() string {
+	if len(k.list) != 0 {
+		key := k.list[0]
+		k.list = k.list[1:]
+		return key
+	}
+	key := strconv.FormatUint(k.start, 10)
+	k.start++
+	k.count--
+	return key
+}
+
+// lines calls parse on each non-empty line, and returns the keys it produces
+// one at a time.
+func lines(r io.Reader, parse func([]string) (keys, error)) sim.Trace {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), LINE_MAX)
+	line, pending := 0, keys{}
+	return func() (string, error) {
+		for pending.empty() {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", sim.ErrDone
+			}
+			line++
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			parsed, err := parse(fields)
+			if err != nil {
+				return "", fmt.Errorf("line %d: %v", line, err)
+			}
+			pending = parsed
+		}
+		return pending.next(), nil
+	}
+}
+
+// sequence returns the keys start through start+count-1, which must not
+// overflow.
+func sequence(start, count uint64) (keys, error) {
+	if start+count < start {
+		return keys{}, ErrFormat
+	}
+	return keys{start: start, count: count}, nil
+}
+
+// ARC reads the .lis traces from the ARC paper, where each line is
+// "<start block> <block count> <ignored> <request number>".
+func ARC(r io.Reader) sim.Trace {
+	return lines(r, func(fields []string) (keys, error) {
+		if len(fields) < 2 {
+			return keys{}, ErrFormat
+		}
+		start, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return keys{}, err
+		}
+		count, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return keys{}, err
+		}
+		return sequence(start, count)
+	})
+}
+
+// LIRS reads the traces from the LIRS paper, where each line is a single block
+// number. Lines starting with '*' are markers and skipped.
+func LIRS(r io.Reader) sim.Trace {
+	return lines(r, func(fields []string) (keys, error) {
+		if fields[0][0] == '*' {
+			return keys{}, nil
+		}
+		if _, err := strconv.ParseUint(fields[0], 10, 64); err != nil {
+			return keys{}, err
+		}
+		return keys{list: fields[:1]}, nil
+	})
+}
+
+// Wikipedia reads the WikiBench access logs, where each line is
+// "<counter> <timestamp> <url> <save flag>". The URL is the key, with the
+// scheme and host stripped so mirrors of the same page share a key.
+func Wikipedia(r io.Reader) sim.Trace {
+	return lines(r, func(fields []string) (keys, error) {
+		if len(fields) < 3 {
+			return keys{}, ErrFormat
+		}
+		url := fields[2]
+		if i := strings.Index(url, "://"); i != -1 {
+			url = url[i+3:]
+			if j := strings.IndexByte(url, '/'); j != -1 {
+				url = url[j:]
+			}
+		}
+		return keys{list: []string{url}}, nil
+	})
+}
+
+// UMass reads the UMass storage and search traces (SPC format), where each
+// line is "<ASU>,<LBA>,<size>,<opcode>,<timestamp>". Each request is split
+// into the BLOCK_SIZE blocks it covers.
+func UMass(r io.Reader) sim.Trace {
+	return lines(r, func(fields []string) (keys, error) {
+		record := strings.Split(fields[0], ",")
+		if len(record) < 3 {
+			return keys{}, ErrFormat
+		}
+		lba, err := strconv.ParseUint(record[1], 10, 64)
+		if err != nil {
+			return keys{}, err
+		}
+		size, err := strconv.ParseUint(record[2], 10, 64)
+		if err != nil {
+			return keys{}, err
+		}
+		count := (size + BLOCK_SIZE - 1) / BLOCK_SIZE
+		if count == 0 {
+			count = 1
+		}
+		return sequence(lba, count)
+	})
+}
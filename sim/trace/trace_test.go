@@ -0,0 +1,113 @@
+package trace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/karlmcguire/experiments-cache/sim"
+)
+
+func collect(t *testing.T, trace sim.Trace) []string {
+	keys, err := Keys(trace, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func blocks(start, count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = strconv.Itoa(start + i)
+	}
+	return keys
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader Reader
+		input  string
+		keys   []string
+	}{
+		{"arc", ARC, "10 3 0 1\n\n20 1 0 2\n", []string{"10", "11", "12", "20"}},
+		{"lirs", LIRS, "5\n*\n7\n5\n", []string{"5", "7", "5"}},
+		{"wikipedia", Wikipedia,
+			"1 1190146243.326 http://en.wikipedia.org/wiki/Go -\n" +
+				"2 1190146243.327 http://de.wikipedia.org/wiki/Go save\n",
+			[]string{"/wiki/Go", "/wiki/Go"}},
+		{"umass", UMass, "0,20941264,8192,w,0.551706\n1,100,512,r,0.6\n",
+			append(blocks(20941264, 16), "100")},
+	}
+	for _, test := range tests {
+		keys := collect(t, test.reader(strings.NewReader(test.input)))
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Fatalf("%s: got %v", test.name, keys)
+		}
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	trace := ARC(strings.NewReader("1 1\nbad\n"))
+	if key, err := trace(); key != "1" || err != nil {
+		t.Fatal("first line error")
+	}
+	if _, err := trace(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestHugeCount checks that the keys of a line are generated as they're read,
+// and that runs overflowing the block numbers are rejected.
+func TestHugeCount(t *testing.T) {
+	keys, err := Keys(ARC(strings.NewReader("1 99999999999 0 1\n")), 3)
+	if err != nil || !reflect.DeepEqual(keys, []string{"1", "2", "3"}) {
+		t.Fatalf("got %v %v", keys, err)
+	}
+	if _, err := ARC(strings.NewReader("18446744073709551615 2 0 1\n"))(); err == nil {
+		t.Fatal("expected overflow error")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write([]byte("1\n2\n3\n"))
+	w.Close()
+
+	for name, data := range map[string][]byte{
+		"plain.lirs":    []byte("1\n2\n3\n"),
+		"gzipped.lirs":  compressed.Bytes(),
+		"empty.lirs.gz": nil,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		trace, closer, err := Open(path, LIRS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := collect(t, trace)
+		closer.Close()
+		if data != nil && !reflect.DeepEqual(keys, []string{"1", "2", "3"}) {
+			t.Fatalf("%s: got %v", name, keys)
+		}
+		if data == nil && len(keys) != 0 {
+			t.Fatal("empty trace error")
+		}
+	}
+}
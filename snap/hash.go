@@ -0,0 +1,253 @@
+package snap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// HASH_SHARDS is the number of independently locked tables.
+	HASH_SHARDS = 64
+	// HASH_MIN_SLOTS is the smallest table size of a shard.
+	HASH_MIN_SLOTS = 8
+	// SAMPLE_BATCH is how many entries Sample copies out of a shard at a
+	// time.
+	SAMPLE_BATCH = 4
+)
+
+type (
+	// hashSlot is an entry in a shard's table. The key is kept as an
+	// interface so Range and Sample don't allocate converting it.
+	hashSlot struct {
+		// hash is 0 for empty slots
+		hash  uint64
+		key   interface{}
+		value interface{}
+	}
+
+	hashShard struct {
+		sync.RWMutex
+		slots []hashSlot
+		mask  uint64
+		count int
+	}
+
+	// HashMap is a striped hash map built for sampled eviction. Each shard is
+	// an open addressing table with linear probing and backward shift
+	// deletion (so there are no tombstones). Tables grow at 3/4 load and
+	// shrink below 1/8, so memory stays proportional to the number of
+	// entries, and Sample can start at a random slot and expect to find an
+	// entry within a few slots.
+	HashMap struct {
+		shards [HASH_SHARDS]hashShard
+		// seed is advanced by every Sample for picking a starting slot
+		seed uint64
+	}
+)
+
+func NewHashMap() *HashMap {
+	m := &HashMap{}
+	for i := range m.shards {
+		m.shards[i].slots = make([]hashSlot, HASH_MIN_SLOTS)
+		m.shards[i].mask = HASH_MIN_SLOTS - 1
+	}
+	return m
+}
+
+// hashKey is FNV-1a finished with mix, which is much faster than the
+// keyed hashes for short keys.
+func hashKey(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	// 0 marks empty slots
+	return mix(hash) | 1
+}
+
+// shard uses the top bits of the hash, the bottom bits index the table.
+func (m *HashMap) shard(hash uint64) *hashShard {
+	return &m.shards[hash>>58]
+}
+
+func (m *HashMap) Get(key string) interface{} {
+	hash := hashKey(key)
+	s := m.shard(hash)
+
+	s.RLock()
+	defer s.RUnlock()
+	if i, ok := s.find(hash, key); ok {
+		return s.slots[i].value
+	}
+	return nil
+}
+
+func (m *HashMap) Set(key string, value interface{}) {
+	hash := hashKey(key)
+	s := m.shard(hash)
+
+	s.Lock()
+	defer s.Unlock()
+	if i, ok := s.find(hash, key); ok {
+		s.slots[i].value = value
+		return
+	}
+	if (s.count+1)*4 > len(s.slots)*3 {
+		s.resize(len(s.slots) * 2)
+	}
+	s.insert(hashSlot{hash, key, value})
+	s.count++
+}
+
+func (m *HashMap) Del(key string) {
+	hash := hashKey(key)
+	s := m.shard(hash)
+
+	s.Lock()
+	defer s.Unlock()
+	i, ok := s.find(hash, key)
+	if !ok {
+		return
+	}
+	s.remove(i)
+	s.count--
+	if len(s.slots) > HASH_MIN_SLOTS && s.count*8 < len(s.slots) {
+		s.resize(len(s.slots) / 2)
+	}
+}
+
+// Len returns the number of entries.
+func (m *HashMap) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += s.count
+		s.RUnlock()
+	}
+	return n
+}
+
+// Range calls f for every entry until it returns false. Each shard's entries
+// are copied before f is called, so f can modify the map.
+func (m *HashMap) Range(f func(key, value interface{}) bool) {
+	var entries []hashSlot
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		entries = entries[:0]
+		for _, slot := range s.slots {
+			if slot.hash != 0 {
+				entries = append(entries, slot)
+			}
+		}
+		s.RUnlock()
+
+		for _, entry := range entries {
+			if !f(entry.key, entry.value) {
+				return
+			}
+		}
+	}
+}
+
+// Sample calls f with entries starting from a random slot of a random shard
+// until it returns false or every entry has been visited. Starting takes O(1)
+// expected time, since no table is less than 1/8 full (except the smallest).
+// Entries are copied out of a shard SAMPLE_BATCH at a time, so f can modify
+// the map.
+func (m *HashMap) Sample(f func(key, value interface{}) bool) {
+	random := mix(atomic.AddUint64(&m.seed, 0x9e3779b97f4a7c15))
+	first := random >> 58
+
+	var batch [SAMPLE_BATCH]hashSlot
+	for i := uint64(0); i < HASH_SHARDS; i++ {
+		s := &m.shards[(first+i)%HASH_SHARDS]
+		// start at a random slot in the first shard, the beginning of the rest
+		start, next := uint64(0), uint64(0)
+		for {
+			s.RLock()
+			if next == 0 && i == 0 {
+				start = random & s.mask
+			}
+			n, visited := 0, uint64(0)
+			for ; next+visited < uint64(len(s.slots)) && n < SAMPLE_BATCH; visited++ {
+				slot := s.slots[(start+next+visited)&s.mask]
+				if slot.hash != 0 {
+					batch[n] = slot
+					n++
+				}
+			}
+			next += visited
+			done := next >= uint64(len(s.slots))
+			s.RUnlock()
+
+			for j := 0; j < n; j++ {
+				if !f(batch[j].key, batch[j].value) {
+					return
+				}
+			}
+			if done {
+				break
+			}
+		}
+	}
+}
+
+// mix is the splitmix64 finalizer.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// find returns the slot holding key.
+func (s *hashShard) find(hash uint64, key string) (uint64, bool) {
+	for i := hash & s.mask; ; i = (i + 1) & s.mask {
+		slot := &s.slots[i]
+		if slot.hash == 0 {
+			return 0, false
+		}
+		if slot.hash == hash && slot.key.(string) == key {
+			return i, true
+		}
+	}
+}
+
+// insert puts a new entry in the first empty slot from its home slot.
+func (s *hashShard) insert(entry hashSlot) {
+	i := entry.hash & s.mask
+	for s.slots[i].hash != 0 {
+		i = (i + 1) & s.mask
+	}
+	s.slots[i] = entry
+}
+
+// remove empties slot i and shifts back the entries after it that would
+// otherwise become unreachable.
+func (s *hashShard) remove(i uint64) {
+	for j := (i + 1) & s.mask; s.slots[j].hash != 0; j = (j + 1) & s.mask {
+		home := s.slots[j].hash & s.mask
+		// move j into the hole at i unless its home is between i and j
+		if (j-home)&s.mask >= (j-i)&s.mask {
+			s.slots[i] = s.slots[j]
+			i = j
+		}
+	}
+	s.slots[i] = hashSlot{}
+}
+
+func (s *hashShard) resize(size int) {
+	old := s.slots
+	s.slots = make([]hashSlot, size)
+	s.mask = uint64(size - 1)
+	for _, slot := range old {
+		if slot.hash != 0 {
+			s.insert(slot)
+		}
+	}
+}
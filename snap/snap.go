@@ -6,6 +6,9 @@ import (
 
 type Map interface {
 	Range(func(interface{}, interface{}) bool)
+	// Sample is like Range but starts at a random entry, for picking eviction
+	// candidates.
+	Sample(func(interface{}, interface{}) bool)
 	Get(string) interface{}
 	Set(string, interface{})
 	Del(string)
@@ -25,6 +28,12 @@ func (m *SyncMap) Range(f func(key, value interface{}) bool) {
 	m.data.Range(f)
 }
 
+// Sample is the same as Range. sync.Map's iteration order isn't specified but
+// it isn't random either, so the same entries tend to come first.
+func (m *SyncMap) Sample(f func(key, value interface{}) bool) {
+	m.data.Range(f)
+}
+
 func (m *SyncMap) Get(key string) interface{} {
 	value, _ := m.data.Load(key)
 	return value
@@ -1,6 +1,8 @@
 package snap
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -36,6 +38,116 @@ func TestSyncMap(t *testing.T) {
 	GenerateTests(func() Map { return NewSyncMap() })(t)
 }
 
+func TestHashMap(t *testing.T) {
+	GenerateTests(func() Map { return NewHashMap() })(t)
+}
+
+func TestHashMapResize(t *testing.T) {
+	m := NewHashMap()
+	for i := 0; i < 10000; i++ {
+		m.Set(fmt.Sprintf("%d", i), i)
+	}
+	if m.Len() != 10000 {
+		t.Fatal("len error")
+	}
+	for i := 0; i < 10000; i += 2 {
+		m.Del(fmt.Sprintf("%d", i))
+	}
+	// deleting shifts entries back, they all have to stay reachable
+	for i := 0; i < 10000; i++ {
+		value := m.Get(fmt.Sprintf("%d", i))
+		if (i%2 == 0) != (value == nil) {
+			t.Fatalf("del error at %d", i)
+		}
+	}
+	for i := 1; i < 10000; i += 2 {
+		m.Del(fmt.Sprintf("%d", i))
+	}
+	for i := range m.shards {
+		if len(m.shards[i].slots) != HASH_MIN_SLOTS || m.shards[i].count != 0 {
+			t.Fatal("expected tables to shrink")
+		}
+	}
+}
+
+func TestHashMapRange(t *testing.T) {
+	m := NewHashMap()
+	for i := 0; i < 1000; i++ {
+		m.Set(fmt.Sprintf("%d", i), i)
+	}
+	seen := make(map[interface{}]bool)
+	m.Range(func(key, value interface{}) bool {
+		// the map can be modified while ranging
+		m.Set(key.(string), value)
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 1000 {
+		t.Fatal("range error")
+	}
+	seen = make(map[interface{}]bool)
+	m.Sample(func(key, value interface{}) bool {
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 1000 {
+		t.Fatal("sample didn't visit every entry")
+	}
+}
+
+func TestHashMapSample(t *testing.T) {
+	m := NewHashMap()
+	for i := 0; i < 1000; i++ {
+		m.Set(fmt.Sprintf("%d", i), i)
+	}
+	// the first sampled entry should be spread over the map
+	first := make(map[interface{}]int)
+	for i := 0; i < 10000; i++ {
+		m.Sample(func(key, value interface{}) bool {
+			first[key]++
+			return false
+		})
+	}
+	if len(first) < 500 {
+		t.Fatalf("expected random samples, got %d distinct keys", len(first))
+	}
+}
+
+func TestHashMapConcurrent(t *testing.T) {
+	m := NewHashMap()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("%d", (i*7+g)%500)
+				m.Set(key, i)
+				m.Get(key)
+				if i%3 == 0 {
+					m.Del(key)
+				}
+				if i%100 == 0 {
+					m.Sample(func(key, value interface{}) bool { return false })
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	n := 0
+	m.Range(func(key, value interface{}) bool {
+		if m.Get(key.(string)) == nil {
+			t.Fatal("unreachable entry")
+		}
+		n++
+		return true
+	})
+	if n != m.Len() {
+		t.Fatal("len error")
+	}
+}
+
 func GenerateBenchmarks(create func() Map) func(b *testing.B) {
 	return func(b *testing.B) {
 		b.Run("get", func(b *testing.B) {
@@ -147,3 +259,35 @@ func GenerateBenchmarks(create func() Map) func(b *testing.B) {
 func BenchmarkSyncmap(b *testing.B) {
 	GenerateBenchmarks(func() Map { return NewSyncMap() })(b)
 }
+
+func BenchmarkHashMap(b *testing.B) {
+	GenerateBenchmarks(func() Map { return NewHashMap() })(b)
+}
+
+// BenchmarkSample picks an eviction candidate out of 4 entries, like the root
+// package's Cache. SyncMap always starts at the same (cache hot) entries, the
+// HashMap pays for a random start with cache misses.
+func BenchmarkSample(b *testing.B) {
+	for name, create := range map[string]func() Map{
+		"sync-map": func() Map { return NewSyncMap() },
+		"hash-map": func() Map { return NewHashMap() },
+	} {
+		b.Run(name, func(b *testing.B) {
+			m := create()
+			for i := 0; i < 100000; i++ {
+				m.Set(fmt.Sprintf("%d", i), i)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := 0
+					m.Sample(func(key, value interface{}) bool {
+						n++
+						return n < 4
+					})
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package typed
+
+import (
+	"sync"
+
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
+	"github.com/karlmcguire/experiments-cache/pkg/stats"
+	"github.com/karlmcguire/experiments-cache/pkg/tinylfu"
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
+
+type (
+	// Cache is a cache with typed keys and values, so values are stored
+	// without boxing and read back without type assertions.
+	Cache[K comparable, V any] interface {
+		// Get returns the value and true on a hit.
+		Get(K) (V, bool)
+		// Set returns false if the key was rejected by an admission policy.
+		Set(K, V) bool
+		Del(K)
+		Len() int
+		Stats() stats.Stats
+	}
+
+	// Hasher hashes keys for sharding and admission. It should spread keys
+	// evenly over all 64 bits.
+	Hasher[K comparable] func(K) uint64
+
+	// Listener is called with every removed key and value, after the cache's
+	// lock is released.
+	Listener[K comparable, V any] func(K, V, removal.Reason)
+
+	// Integer is any integer type, for the Int hasher.
+	Integer interface {
+		~int | ~int8 | ~int16 | ~int32 | ~int64 |
+			~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+	}
+)
+
+// String hashes string keys with FNV-1a (finished with a mix so the high bits
+// used for sharding are spread too), without allocating.
+func String[K ~string](key K) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return mix(hash)
+}
+
+// Int hashes integer keys.
+func Int[K Integer](key K) uint64 {
+	return mix(uint64(key))
+}
+
+// mix is the splitmix64 finalizer.
+func mix(hash uint64) uint64 {
+	hash ^= hash >> 30
+	hash *= 0xbf58476d1ce4e5b9
+	hash ^= hash >> 27
+	hash *= 0x94d049bb133111eb
+	hash ^= hash >> 31
+	return hash
+}
+
+// SHARDS is the default number of shards of an LRU.
+const SHARDS = 16
+
+////////////////////////////////////////////////////////////////////////////////
+
+type (
+	// lruNode is an entry and its place in its shard's list.
+	lruNode[K comparable, V any] struct {
+		key        K
+		value      V
+		hash       uint64
+		prev, next *lruNode[K, V]
+	}
+
+	lruRemoval[K comparable, V any] struct {
+		key    K
+		value  V
+		reason removal.Reason
+	}
+
+	lruShard[K comparable, V any] struct {
+		sync.Mutex
+		data map[K]*lruNode[K, V]
+		// root.next is the most recently used node and root.prev the least
+		root     lruNode[K, V]
+		admit    *tinylfu.TinyLFU
+		listener Listener[K, V]
+		size     int
+		capacity int
+	}
+
+	// LRU is a sharded LRU cache, optionally with TinyLFU admission. Each
+	// shard holds an equal part of the capacity, so the cache as a whole
+	// only approximates LRU order.
+	LRU[K comparable, V any] struct {
+		shards []*lruShard[K, V]
+		mask   uint64
+		hasher Hasher[K]
+		stats  *stats.Recorder
+	}
+)
+
+// NewLRU returns an LRU cache holding at most capacity entries.
+func NewLRU[K comparable, V any](capacity int, hasher Hasher[K]) *LRU[K, V] {
+	return newLRU[K, V](capacity, hasher, false)
+}
+
+// NewTinyLFU returns an LRU cache that only admits new keys when the cache is
+// full if TinyLFU estimates them to be accessed more often than the LRU victim.
+func NewTinyLFU[K comparable, V any](capacity int, hasher Hasher[K]) *LRU[K, V] {
+	return newLRU[K, V](capacity, hasher, true)
+}
+
+func newLRU[K comparable, V any](capacity int, hasher Hasher[K], admit bool) *LRU[K, V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	// every shard holds at least a few entries
+	shards := SHARDS
+	for shards > 1 && capacity/shards < 4 {
+		shards /= 2
+	}
+
+	c := &LRU[K, V]{
+		shards: make([]*lruShard[K, V], shards),
+		mask:   uint64(shards - 1),
+		hasher: hasher,
+		stats:  stats.NewRecorder(),
+	}
+	for i := range c.shards {
+		shard := &lruShard[K, V]{
+			data:     make(map[K]*lruNode[K, V]),
+			capacity: capacity / shards,
+		}
+		// the remainder goes to the first shards
+		if i < capacity%shards {
+			shard.capacity++
+		}
+		shard.root.next, shard.root.prev = &shard.root, &shard.root
+		if admit {
+			shard.admit = tinylfu.New(util.Near(uint64(shard.capacity)))
+		}
+		c.shards[i] = shard
+	}
+	return c
+}
+
+// shard uses the high bits of the hash, the low bits index the sketch.
+func (c *LRU[K, V]) shard(hash uint64) *lruShard[K, V] {
+	return c.shards[(hash>>32)&c.mask]
+}
+
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	hash := c.hasher(key)
+	shard := c.shard(hash)
+
+	shard.Lock()
+	if shard.admit != nil {
+		shard.admit.Increment(hash)
+	}
+	node, exists := shard.data[key]
+	if !exists {
+		shard.Unlock()
+		c.stats.Get(false)
+		var zero V
+		return zero, false
+	}
+	shard.moveToFront(node)
+	value := node.value
+	shard.Unlock()
+
+	c.stats.Get(true)
+	return value, true
+}
+
+// Set adds or replaces the value, evicting the least recently used entry of
+// the key's shard if it's full.
+func (c *LRU[K, V]) Set(key K, value V) bool {
+	hash := c.hasher(key)
+	shard := c.shard(hash)
+	var removed []lruRemoval[K, V]
+
+	shard.Lock()
+	listener := shard.listener
+	if node, exists := shard.data[key]; exists {
+		if listener != nil {
+			removed = append(removed, lruRemoval[K, V]{key, node.value, removal.REPLACED})
+		}
+		node.value = value
+		shard.moveToFront(node)
+		shard.Unlock()
+
+		c.stats.Set(1, true)
+		deliver(listener, removed)
+		return true
+	}
+
+	if shard.admit != nil {
+		shard.admit.Increment(hash)
+	}
+	if shard.size >= shard.capacity {
+		victim := shard.root.prev
+		if shard.admit != nil && !shard.admit.Admit(hash, victim.hash) {
+			shard.Unlock()
+
+			c.stats.Set(1, false)
+			if listener != nil {
+				listener(key, value, removal.REJECTED)
+			}
+			return false
+		}
+		shard.remove(victim)
+		c.stats.Evict(stats.SIZE, 1)
+		if listener != nil {
+			removed = append(removed, lruRemoval[K, V]{victim.key, victim.value, removal.SIZE})
+		}
+	}
+
+	node := &lruNode[K, V]{key: key, value: value, hash: hash}
+	shard.data[key] = node
+	shard.pushFront(node)
+	shard.size++
+	shard.Unlock()
+
+	c.stats.Set(1, true)
+	deliver(listener, removed)
+	return true
+}
+
+func (c *LRU[K, V]) Del(key K) {
+	shard := c.shard(c.hasher(key))
+
+	shard.Lock()
+	node, exists := shard.data[key]
+	if !exists {
+		shard.Unlock()
+		return
+	}
+	shard.remove(node)
+	listener := shard.listener
+	shard.Unlock()
+
+	if listener != nil {
+		listener(node.key, node.value, removal.EXPLICIT)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *LRU[K, V]) Len() int {
+	n := 0
+	for _, shard := range c.shards {
+		shard.Lock()
+		n += shard.size
+		shard.Unlock()
+	}
+	return n
+}
+
+// OnEvict sets the listener called with every removed entry.
+func (c *LRU[K, V]) OnEvict(listener Listener[K, V]) {
+	for _, shard := range c.shards {
+		shard.Lock()
+		shard.listener = listener
+		shard.Unlock()
+	}
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *LRU[K, V]) Stats() stats.Stats {
+	return c.stats.Snapshot()
+}
+
+func deliver[K comparable, V any](listener Listener[K, V], removed []lruRemoval[K, V]) {
+	for _, r := range removed {
+		listener(r.key, r.value, r.reason)
+	}
+}
+
+func (s *lruShard[K, V]) pushFront(node *lruNode[K, V]) {
+	node.prev, node.next = &s.root, s.root.next
+	s.root.next.prev = node
+	s.root.next = node
+}
+
+func (s *lruShard[K, V]) unlink(node *lruNode[K, V]) {
+	node.prev.next, node.next.prev = node.next, node.prev
+	node.prev, node.next = nil, nil
+}
+
+func (s *lruShard[K, V]) moveToFront(node *lruNode[K, V]) {
+	if s.root.next == node {
+		return
+	}
+	s.unlink(node)
+	s.pushFront(node)
+}
+
+func (s *lruShard[K, V]) remove(node *lruNode[K, V]) {
+	s.unlink(node)
+	delete(s.data, node.key)
+	s.size--
+}
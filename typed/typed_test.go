@@ -0,0 +1,155 @@
+package typed
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/karlmcguire/experiments-cache/pkg/removal"
+)
+
+var _ Cache[string, int] = (*LRU[string, int])(nil)
+
+type point struct{ x, y int }
+
+func TestLRU(t *testing.T) {
+	c := NewLRU[string, point](4, String[string])
+	c.Set("a", point{1, 2})
+	if value, ok := c.Get("a"); !ok || value != (point{1, 2}) {
+		t.Fatal("get error")
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("miss error")
+	}
+	c.Set("a", point{3, 4})
+	if value, _ := c.Get("a"); value != (point{3, 4}) {
+		t.Fatal("replace error")
+	}
+	c.Del("a")
+	if _, ok := c.Get("a"); ok || c.Len() != 0 {
+		t.Fatal("del error")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Sets != 2 {
+		t.Fatalf("stats error: %+v", stats)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	// small enough to be a single shard, so eviction is exact LRU
+	c := NewLRU[int, int](4, Int[int])
+	for i := 0; i < 4; i++ {
+		c.Set(i, i)
+	}
+	c.Get(0)
+	c.Set(4, 4)
+	if _, ok := c.Get(1); ok {
+		t.Fatal("expected least recently used key to be evicted")
+	}
+	for _, key := range []int{0, 2, 3, 4} {
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("expected %d to stay", key)
+		}
+	}
+
+	// sharded caches stay within capacity
+	c = NewLRU[int, int](1000, Int[int])
+	for i := 0; i < 10000; i++ {
+		c.Set(i, i)
+	}
+	if c.Len() != 1000 || c.Stats().TotalEvictions() != 9000 {
+		t.Fatalf("expected 1000 entries, got %d", c.Len())
+	}
+}
+
+func TestTinyLFU(t *testing.T) {
+	c := NewTinyLFU[string, int](4, String[string])
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("%d", i)
+		c.Set(key, i)
+		for j := 0; j < 8; j++ {
+			c.Get(key)
+		}
+	}
+	// a one-hit wonder doesn't replace the frequently accessed keys
+	if c.Set("new", 4) {
+		t.Fatal("expected cold key to be rejected")
+	}
+	if c.Stats().Rejections != 1 || c.Len() != 4 {
+		t.Fatal("rejection error")
+	}
+}
+
+func TestLRUOnEvict(t *testing.T) {
+	c := NewLRU[int, string](1, Int[int])
+	removed := make(map[removal.Reason][]int)
+	c.OnEvict(func(key int, value string, reason removal.Reason) {
+		// the lock is released, so the cache can be used
+		c.Len()
+		removed[reason] = append(removed[reason], key)
+	})
+
+	c.Set(1, "1")
+	c.Set(1, "one")
+	c.Set(2, "2")
+	c.Del(2)
+	if len(removed[removal.REPLACED]) != 1 || len(removed[removal.SIZE]) != 1 ||
+		len(removed[removal.EXPLICIT]) != 1 || removed[removal.EXPLICIT][0] != 2 {
+		t.Fatalf("listener error: %v", removed)
+	}
+}
+
+func TestHashers(t *testing.T) {
+	if String("a") == String("b") || Int(1) == Int(2) {
+		t.Fatal("hash collision")
+	}
+	type id uint32
+	if Int(id(7)) != Int(uint64(7)) {
+		t.Fatal("expected integer types to hash alike")
+	}
+	// the shard bits should differ for sequential keys
+	shards := make(map[uint64]bool)
+	for i := 0; i < 64; i++ {
+		shards[(Int(i)>>32)&(SHARDS-1)] = true
+	}
+	if len(shards) < SHARDS/2 {
+		t.Fatal("expected keys to spread over shards")
+	}
+}
+
+func TestLRUAllocs(t *testing.T) {
+	c := NewLRU[string, int](64, String[string])
+	c.Set("key", 1)
+	if allocs := testing.AllocsPerRun(100, func() { c.Get("key") }); allocs != 0 {
+		t.Fatalf("expected no allocations on a hit, got %v", allocs)
+	}
+}
+
+func BenchmarkLRUGet(b *testing.B) {
+	c := NewLRU[int, int](1024, Int[int])
+	for i := 0; i < 1024; i++ {
+		c.Set(i, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.Get(i & 1023)
+			i++
+		}
+	})
+}
+
+func BenchmarkLRUSet(b *testing.B) {
+	c := NewLRU[int, int](1024, Int[int])
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.Set(i&4095, i)
+			i++
+		}
+	})
+}
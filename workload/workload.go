@@ -0,0 +1,219 @@
+// Package workload generates synthetic key access patterns for stressing cache
+// policies: skewed, uniform, hotspot, shifting and scan-heavy distributions,
+// along with YCSB style read/write/delete operation mixes.
+//
+// Generators aren't safe for concurrent use, each goroutine should create its
+// own (with its own seed).
+package workload
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/karlmcguire/experiments-cache/pkg/util"
+)
+
+// Generator returns key indexes in [0, n) following some distribution.
+type Generator interface {
+	Next() uint64
+}
+
+// Inserter is implemented by generators whose key space grows as keys are
+// inserted (such as Latest), so workloads can insert keys they'll then read.
+type Inserter interface {
+	// Insert adds a key to the key space and returns its index.
+	Insert() uint64
+}
+
+// GeneratorFunc adapts a function to the Generator interface.
+type GeneratorFunc func() uint64
+
+func (f GeneratorFunc) Next() uint64 {
+	return f()
+}
+
+// Key formats a key index the same way across all generators.
+func Key(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+// Keys returns the next count keys from the generator.
+func Keys(gen Generator, count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = Key(gen.Next())
+	}
+	return keys
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewUniform returns every key in [0, n) with equal probability.
+func NewUniform(seed int64, n uint64) Generator {
+	rng := rand.New(rand.NewSource(seed))
+	return GeneratorFunc(func() uint64 {
+		return uint64(rng.Int63n(int64(n)))
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Zipf returns keys in [0, n) where key i has probability proportional to
+// 1/(i+1)^s, so low keys are the most popular. Any skew s > 0 is supported:
+// for s < 1 (YCSB uses 0.99) the Gray et al. algorithm is used, for s > 1 the
+// math/rand generator is used.
+type Zipf struct {
+	rng   *rand.Rand
+	n     uint64
+	alpha float64
+	zetan float64
+	eta   float64
+	half  float64
+	large *rand.Zipf
+}
+
+func NewZipf(seed int64, s float64, n uint64) *Zipf {
+	z := &Zipf{rng: rand.New(rand.NewSource(seed)), n: n}
+	if s == 1 {
+		// both algorithms are undefined at exactly 1
+		s = 1 + 1e-6
+	}
+	if s > 1 {
+		z.large = rand.NewZipf(z.rng, s, 1, n-1)
+		return z
+	}
+	z.zetan = zeta(n, s)
+	z.alpha = 1 / (1 - s)
+	z.eta = (1 - math.Pow(2/float64(n), 1-s)) / (1 - zeta(2, s)/z.zetan)
+	z.half = 1 + math.Pow(0.5, s)
+	return z
+}
+
+func zeta(n uint64, theta float64) float64 {
+	sum := float64(0)
+	for i := uint64(1); i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+func (z *Zipf) Next() uint64 {
+	if z.large != nil {
+		return z.large.Uint64()
+	}
+	u := z.rng.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < z.half {
+		return 1
+	}
+	n := uint64(float64(z.n) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if n >= z.n {
+		n = z.n - 1
+	}
+	return n
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewScrambledZipf has the same popularity skew as Zipf but scatters the
+// popular keys across the key space, so they don't cluster at low indexes
+// (which would otherwise favor range partitioned shards).
+func NewScrambledZipf(seed int64, s float64, n uint64) Generator {
+	zipf := NewZipf(seed, s, n)
+	buf := make([]byte, 8)
+	return GeneratorFunc(func() uint64 {
+		binary.LittleEndian.PutUint64(buf, zipf.Next())
+		return util.Hash64(buf) % n
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewHotspot returns keys from the first hotFraction of the key space with
+// probability hotRatio, and from the rest of the key space otherwise (both
+// uniformly).
+func NewHotspot(seed int64, n uint64, hotFraction, hotRatio float64) Generator {
+	rng := rand.New(rand.NewSource(seed))
+	hot := uint64(float64(n) * hotFraction)
+	if hot == 0 {
+		hot = 1
+	}
+	if hot > n {
+		hot = n
+	}
+	return GeneratorFunc(func() uint64 {
+		if hot == n || rng.Float64() < hotRatio {
+			return uint64(rng.Int63n(int64(hot)))
+		}
+		return hot + uint64(rng.Int63n(int64(n-hot)))
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Latest favors the most recently inserted keys, following a Zipf
+// distribution over recency. The key space grows with each Insert.
+type Latest struct {
+	zipf *Zipf
+	max  uint64
+}
+
+// NewLatest creates a Latest generator with n keys already inserted. Recency
+// is skewed over a window of the n most recent keys.
+func NewLatest(seed int64, s float64, n uint64) *Latest {
+	return &Latest{zipf: NewZipf(seed, s, n), max: n}
+}
+
+func (l *Latest) Next() uint64 {
+	return l.max - 1 - l.zipf.Next()
+}
+
+func (l *Latest) Insert() uint64 {
+	l.max++
+	return l.max - 1
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewShifting is a Zipf distribution whose popular keys drift: every period
+// requests the popularity ranking rotates by one key, so yesterday's hot keys
+// slowly go cold.
+func NewShifting(seed int64, s float64, n, period uint64) Generator {
+	zipf := NewZipf(seed, s, n)
+	requests, offset := uint64(0), uint64(0)
+	return GeneratorFunc(func() uint64 {
+		requests++
+		if requests%period == 0 {
+			offset++
+		}
+		return (zipf.Next() + offset) % n
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// NewScan interleaves the hot generator with sequential scans: with
+// probability scanRatio a scan of scanLength keys starts, continuing from
+// where the last scan stopped, over the cold keys [hot, n).
+func NewScan(seed int64, hot Generator, hotKeys, n uint64, scanLength uint64,
+	scanRatio float64) Generator {
+	rng := rand.New(rand.NewSource(seed))
+	cursor, remaining := uint64(0), uint64(0)
+	return GeneratorFunc(func() uint64 {
+		if remaining == 0 && rng.Float64() < scanRatio {
+			remaining = scanLength
+		}
+		if remaining == 0 || hotKeys >= n {
+			return hot.Next()
+		}
+		remaining--
+		key := hotKeys + cursor
+		cursor = (cursor + 1) % (n - hotKeys)
+		return key
+	})
+}
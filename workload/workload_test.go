@@ -0,0 +1,154 @@
+package workload
+
+import (
+	"testing"
+)
+
+const (
+	SAMPLES = 100000
+	SPACE   = 1000
+)
+
+func counts(gen Generator) []int {
+	counts := make([]int, SPACE)
+	for i := 0; i < SAMPLES; i++ {
+		n := gen.Next()
+		if n >= SPACE {
+			panic("key out of range")
+		}
+		counts[n]++
+	}
+	return counts
+}
+
+func TestZipf(t *testing.T) {
+	for _, s := range []float64{0.5, 0.99, 1, 1.5, 2.1} {
+		c := counts(NewZipf(1, s, SPACE))
+		if c[0] <= c[1] || c[1] <= c[10] || c[10] < c[SPACE-1] {
+			t.Fatalf("s=%v: not skewed %d %d %d", s, c[0], c[1], c[10])
+		}
+	}
+	// higher skew concentrates more on the first key
+	if counts(NewZipf(1, 0.5, SPACE))[0] >= counts(NewZipf(1, 0.99, SPACE))[0] {
+		t.Fatal("skew error")
+	}
+}
+
+func TestScrambledZipf(t *testing.T) {
+	c := counts(NewScrambledZipf(1, 0.99, SPACE))
+	max := 0
+	for i := range c {
+		if c[i] > c[max] {
+			max = i
+		}
+	}
+	if max == 0 || c[max] < SAMPLES/20 {
+		t.Fatal("scramble error")
+	}
+}
+
+func TestUniform(t *testing.T) {
+	for _, n := range counts(NewUniform(1, SPACE)) {
+		if n < SAMPLES/SPACE/2 || n > SAMPLES/SPACE*2 {
+			t.Fatal("uniform error")
+		}
+	}
+}
+
+func TestHotspot(t *testing.T) {
+	c, hot := counts(NewHotspot(1, SPACE, 0.1, 0.9)), 0
+	for _, n := range c[:SPACE/10] {
+		hot += n
+	}
+	if hot < SAMPLES*85/100 || hot > SAMPLES*95/100 {
+		t.Fatal("hotspot error")
+	}
+}
+
+func TestLatest(t *testing.T) {
+	latest := NewLatest(1, 0.99, SPACE)
+	if latest.Next() >= SPACE {
+		t.Fatal("latest out of range")
+	}
+	if key := latest.Insert(); key != SPACE {
+		t.Fatal("insert error")
+	}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if latest.Next() == SPACE {
+			hits++
+		}
+	}
+	if hits < 50 {
+		t.Fatal("latest key not popular")
+	}
+}
+
+func TestShifting(t *testing.T) {
+	shifting := NewShifting(1, 2.1, SPACE, SAMPLES/4)
+	early, late := make([]int, SPACE), make([]int, SPACE)
+	for i := 0; i < SAMPLES; i++ {
+		if i < SAMPLES/4-1 {
+			early[shifting.Next()]++
+		} else if i >= SAMPLES*3/4 {
+			late[shifting.Next()]++
+		} else {
+			shifting.Next()
+		}
+	}
+	if early[0] < SAMPLES/8 || late[0] != 0 || late[3] < SAMPLES/8 {
+		t.Fatal("shifting error")
+	}
+}
+
+func TestScan(t *testing.T) {
+	scan := NewScan(1, NewUniform(1, 10), 10, SPACE, 50, 0.01)
+	sequential, last := 0, uint64(0)
+	for i := 0; i < SAMPLES; i++ {
+		n := scan.Next()
+		if n >= SPACE {
+			t.Fatal("scan out of range")
+		}
+		if n >= 10 && last >= 10 && n == last+1 {
+			sequential++
+		}
+		last = n
+	}
+	if sequential < SAMPLES/10 {
+		t.Fatal("scan error")
+	}
+}
+
+func TestWorkload(t *testing.T) {
+	for _, mix := range []Mix{YCSB_A, YCSB_B, YCSB_C, YCSB_D, YCSB_E, YCSB_F,
+		{Read: 0.8, Delete: 0.2}} {
+		var keys Generator = NewZipf(1, 0.99, SPACE)
+		if mix == YCSB_D {
+			keys = NewLatest(1, 0.99, SPACE)
+		}
+		w := NewWorkload(1, mix, keys, SPACE)
+		ops := make(map[Op]int)
+		for i := 0; i < SAMPLES; i++ {
+			op := w.Next()
+			ops[op.Op]++
+			if op.Length < 1 || op.Length > SCAN_MAX {
+				t.Fatal("length error")
+			}
+		}
+		for op, want := range map[Op]float64{READ: mix.Read, UPDATE: mix.Update,
+			INSERT: mix.Insert, SCAN: mix.Scan,
+			READ_MODIFY_WRITE: mix.ReadModifyWrite, DELETE: mix.Delete} {
+			got := float64(ops[op]) / SAMPLES
+			if got < want-0.01 || got > want+0.01 {
+				t.Fatalf("%v: got %v want %v", op, got, want)
+			}
+		}
+	}
+}
+
+func TestWorkloadInsert(t *testing.T) {
+	w := NewWorkload(1, Mix{Insert: 1}, NewUniform(1, SPACE), SPACE)
+	if w.Next().Key != "1000" || w.Next().Key != "1001" {
+		t.Fatal("insert error")
+	}
+}
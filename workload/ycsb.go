@@ -0,0 +1,129 @@
+package workload
+
+import (
+	"math/rand"
+)
+
+type Op int
+
+const (
+	READ Op = iota
+	UPDATE
+	INSERT
+	SCAN
+	READ_MODIFY_WRITE
+	DELETE
+)
+
+func (o Op) String() string {
+	switch o {
+	case READ:
+		return "read"
+	case UPDATE:
+		return "update"
+	case INSERT:
+		return "insert"
+	case SCAN:
+		return "scan"
+	case READ_MODIFY_WRITE:
+		return "read-modify-write"
+	case DELETE:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Operation is a single request in a workload. Length is the number of keys
+// (starting at Key) covered by a SCAN, and 1 otherwise.
+type Operation struct {
+	Op     Op
+	Key    string
+	Length int
+}
+
+// Mix is the proportion of each operation in a workload, the proportions
+// don't need to add up to 1.
+type Mix struct {
+	Read            float64
+	Update          float64
+	Insert          float64
+	Scan            float64
+	ReadModifyWrite float64
+	Delete          float64
+}
+
+// The standard YCSB core workloads. D should be paired with a Latest
+// generator, the others with Zipf (or ScrambledZipf).
+var (
+	// YCSB_A is update heavy (session store).
+	YCSB_A = Mix{Read: 0.5, Update: 0.5}
+	// YCSB_B is read mostly (photo tagging).
+	YCSB_B = Mix{Read: 0.95, Update: 0.05}
+	// YCSB_C is read only (user profile cache).
+	YCSB_C = Mix{Read: 1}
+	// YCSB_D is read latest (status updates).
+	YCSB_D = Mix{Read: 0.95, Insert: 0.05}
+	// YCSB_E is short ranges (threaded conversations).
+	YCSB_E = Mix{Scan: 0.95, Insert: 0.05}
+	// YCSB_F is read-modify-write (user database).
+	YCSB_F = Mix{Read: 0.5, ReadModifyWrite: 0.5}
+)
+
+// SCAN_MAX is the longest scan generated, scan lengths are uniform in
+// [1, SCAN_MAX] as in YCSB.
+const SCAN_MAX = 100
+
+// Workload generates operations following a Mix, with keys from a Generator.
+type Workload struct {
+	rng      *rand.Rand
+	keys     Generator
+	inserted uint64
+	bounds   [6]float64
+}
+
+// NewWorkload creates a workload whose key space is [0, n) before any
+// inserts. If keys implements Inserter it decides inserted key indexes,
+// otherwise inserted keys are numbered from n.
+func NewWorkload(seed int64, mix Mix, keys Generator, n uint64) *Workload {
+	w := &Workload{
+		rng:      rand.New(rand.NewSource(seed)),
+		keys:     keys,
+		inserted: n,
+	}
+	total := float64(0)
+	for i, p := range []float64{mix.Read, mix.Update, mix.Insert, mix.Scan,
+		mix.ReadModifyWrite, mix.Delete} {
+		total += p
+		w.bounds[i] = total
+	}
+	for i := range w.bounds {
+		w.bounds[i] /= total
+	}
+	return w
+}
+
+func (w *Workload) Next() Operation {
+	u := w.rng.Float64()
+	op := DELETE
+	for i, bound := range w.bounds {
+		if u < bound {
+			op = Op(i)
+			break
+		}
+	}
+	switch op {
+	case INSERT:
+		if inserter, ok := w.keys.(Inserter); ok {
+			return Operation{Op: op, Key: Key(inserter.Insert()), Length: 1}
+		}
+		w.inserted++
+		return Operation{Op: op, Key: Key(w.inserted - 1), Length: 1}
+	case SCAN:
+		return Operation{
+			Op:     op,
+			Key:    Key(w.keys.Next()),
+			Length: 1 + w.rng.Intn(SCAN_MAX),
+		}
+	}
+	return Operation{Op: op, Key: Key(w.keys.Next()), Length: 1}
+}